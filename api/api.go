@@ -2,8 +2,12 @@ package api
 
 import (
 	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/auth"
+	"github.com/kxlt/imageresizer/coalesce"
 	"github.com/kxlt/imageresizer/collections"
 	"github.com/kxlt/imageresizer/config"
+	"github.com/kxlt/imageresizer/etag"
+	"github.com/kxlt/imageresizer/imager"
 	"github.com/kxlt/imageresizer/store"
 	"github.com/rcrowley/go-metrics"
 	"github.com/rcrowley/go-metrics/exp"
@@ -22,7 +26,12 @@ type Api struct {
 	Thumbnails store.Cache
 	Tiers      *collections.SyncStrSet
 	Etags      *collections.SyncStrSet
+	Imager     imager.Imager
+	Auth       *auth.Authenticator
 	*mux.Router
+
+	resizes coalesce.Group
+	presets map[string]*preset
 }
 
 func NewApi(ready chan<- bool) *Api {
@@ -68,8 +77,11 @@ func NewApi(ready chan<- bool) *Api {
 		Thumbnails: thumbCache,
 		Tiers:      collections.NewSyncStrSet(),
 		Etags:      etags,
+		Imager:     imager.New(imagerConfig()),
+		Auth:       newAuthenticator(),
 		Router:     mux.NewRouter().StrictSlash(true),
 	}
+	api.initPresets()
 	go api.initCacheLoader(ready)
 	api.initCacheManager()
 	if config.C.EtagCacheEnable {
@@ -79,6 +91,33 @@ func NewApi(ready chan<- bool) *Api {
 	return api
 }
 
+// imagerConfig returns the imager settings of the config.
+func imagerConfig() imager.Config {
+	return imager.Config{
+		JPEGQuality:            config.C.EncodeJPEGQuality,
+		JPEGProgressive:        config.C.EncodeJPEGProgressive,
+		PNGCompression:         config.C.EncodePNGCompression,
+		WebPQuality:            config.C.EncodeWebPQuality,
+		AVIFQuality:            config.C.EncodeAVIFQuality,
+		MaxWidth:               config.C.LimitsMaxWidth,
+		MaxHeight:              config.C.LimitsMaxHeight,
+		MaxMegapixels:          config.C.LimitsMaxMegapixels,
+		MaxPages:               config.C.LimitsMaxPages,
+		AnimationEnable:        config.C.AnimationEnable,
+		AnimationMaxFrames:     config.C.AnimationMaxFrames,
+		AnimationMaxMegapixels: config.C.AnimationMaxMegapixels,
+		ColorConvert:           config.C.ColorConvert,
+		MetadataPolicy:         imager.MetadataPolicy[config.C.MetadataPolicy],
+		Timeout:                time.Duration(config.C.ImagerTimeout) * time.Millisecond,
+		Workers:                config.C.ImagerWorkers,
+		QueueSize:              config.C.ImagerQueueSize,
+		VipsConcurrency:        config.C.ImagerVipsConcurrency,
+		VipsCacheMax:           config.C.ImagerVipsCacheMax,
+		VipsCacheMaxMem:        config.C.ImagerVipsCacheMaxMem,
+		VipsCacheMaxFiles:      config.C.ImagerVipsCacheMaxFiles,
+	}
+}
+
 func (api *Api) initCacheLoader(ready chan<- bool) {
 	log.Println("Loading caches...")
 	err := api.Originals.LoadCache(nil)
@@ -86,11 +125,22 @@ func (api *Api) initCacheLoader(ready chan<- bool) {
 		ready <- false
 		return
 	}
+	var stale []string
 	api.Thumbnails.LoadCache(func(item interface{}) error {
 		filename := item.(string)
+		if api.stalePresetThumbnail(filename) {
+			stale = append(stale, filename)
+			return nil
+		}
 		api.Tiers.Add(path.Dir(filename))
 		return nil
 	})
+	if len(stale) > 0 {
+		log.Printf("Removing %d thumbnails of changed or removed presets", len(stale))
+	}
+	for _, filename := range stale {
+		api.Thumbnails.Remove(filename)
+	}
 	if err != nil {
 		ready <- false
 		return
@@ -123,6 +173,22 @@ func (api *Api) initEtagManager() {
 
 func (api *Api) removeThumbnails(filePath string) {
 	api.Tiers.Walk(func(item string) {
-		api.Thumbnails.Remove(item + "/" + filePath)
+		api.removeThumbnail(item + "/" + filePath)
+		api.Thumbnails.Remove(item + "/" + filePath + qualitySuffix)
+		for format := range extensions {
+			api.removeThumbnail(item + "/" + filePath + formatSuffix(format))
+			api.Thumbnails.Remove(item + "/" + filePath + formatSuffix(format) + qualitySuffix)
+		}
 	})
 }
+
+// removeThumbnail removes a cached thumbnail and forgets its etag, so clients
+// revalidating it get the thumbnail replacing it.
+func (api *Api) removeThumbnail(thumbPath string) {
+	if config.C.EtagCacheEnable {
+		if buf, _ := api.Thumbnails.Get(thumbPath); buf != nil {
+			api.Etags.Remove(etag.Generate(buf, true))
+		}
+	}
+	api.Thumbnails.Remove(thumbPath)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"crypto/rsa"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/auth"
+	"github.com/kxlt/imageresizer/config"
+)
+
+func newAuthenticator() *auth.Authenticator {
+	keys := make(map[string]*auth.Grant)
+	for _, key := range config.C.AuthKeys {
+		keys[key.Key] = &auth.Grant{Scopes: key.Scopes, Prefixes: key.Prefixes}
+	}
+	var secret []byte
+	if config.C.AuthJWTSecret != "" {
+		secret = []byte(config.C.AuthJWTSecret)
+	}
+	var publicKey *rsa.PublicKey
+	if config.C.AuthJWTPublicKey != "" {
+		buf, err := ioutil.ReadFile(config.C.AuthJWTPublicKey)
+		if err != nil {
+			log.Fatalln("Could not read JWT public key:", err)
+		}
+		publicKey, err = auth.ParseRSAPublicKey(buf)
+		if err != nil {
+			log.Fatalln("Could not parse JWT public key:", err)
+		}
+	}
+	return auth.New(keys, secret, publicKey)
+}
+
+// authMiddleware requires requests to be authenticated with an API key or JWT
+// granting scope on the requested path, when scope is in auth.required.
+func (api *Api) authMiddleware(scope string, h http.HandlerFunc) http.HandlerFunc {
+	return api.authVarMiddleware(scope, "path", h)
+}
+
+// authVarMiddleware is authMiddleware for routes with the path in another
+// route var, e.g. the identifier of IIIF URLs.
+func (api *Api) authVarMiddleware(scope string, pathVar string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if api.authorize(w, r, scope, mux.Vars(r)[pathVar]) {
+			h(w, r)
+		}
+	}
+}
+
+// authorize reports whether r is authenticated with a grant of scope on the
+// original at path, when scope is in auth.required, or responds with the
+// error. Routes whose path isn't a route var, e.g. Thumbor, call it once they
+// know the original's path, before answering 304 Not Modified.
+func (api *Api) authorize(w http.ResponseWriter, r *http.Request, scope string, path string) bool {
+	if !authRequired(scope) {
+		return true
+	}
+	grant, err := api.Auth.Authenticate(r, time.Now())
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="imageresizer"`)
+		respondWithErr(w, http.StatusUnauthorized)
+		return false
+	}
+	if !grant.Allows(scope, path) {
+		respondWithErr(w, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func authRequired(scope string) bool {
+	for _, required := range config.C.AuthRequired {
+		if required == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/auth"
+	"github.com/kxlt/imageresizer/collections"
+	"github.com/kxlt/imageresizer/config"
+	"github.com/kxlt/imageresizer/store"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	defer func(required []string) { config.C.AuthRequired = required }(config.C.AuthRequired)
+	config.C.AuthRequired = []string{auth.UPLOAD, auth.DELETE}
+
+	api := newTestApi()
+	api.Auth = auth.New(map[string]*auth.Grant{
+		"uploader": {Scopes: []string{auth.UPLOAD}, Prefixes: []string{"products/"}},
+	}, nil, nil)
+	api.Router = mux.NewRouter()
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	api.HandleFunc("/"+pathMatch, api.authMiddleware(auth.READ, ok)).Methods("GET")
+	api.HandleFunc("/"+pathMatch, api.authMiddleware(auth.UPLOAD, ok)).Methods("POST")
+	api.HandleFunc("/"+pathMatch, api.authMiddleware(auth.DELETE, ok)).Methods("DELETE")
+
+	tests := []struct {
+		method string
+		path   string
+		key    string
+		status int
+	}{
+		{"GET", "/products/photo.jpg", "", http.StatusOK},
+		{"POST", "/products/photo.jpg", "", http.StatusUnauthorized},
+		{"POST", "/products/photo.jpg", "wrong", http.StatusUnauthorized},
+		{"POST", "/products/photo.jpg", "uploader", http.StatusOK},
+		{"POST", "/users/photo.jpg", "uploader", http.StatusForbidden},
+		{"DELETE", "/products/photo.jpg", "uploader", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if test.key != "" {
+			r.Header.Set("Authorization", "Bearer "+test.key)
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s %s with key %q: expected status %d, got %d",
+				test.method, test.path, test.key, test.status, w.Code)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s %s: missing WWW-Authenticate header", test.method, test.path)
+		}
+	}
+}
+
+func TestRoutes_AuthRead(t *testing.T) {
+	defer func(c config.Config) { config.C = c }(config.C)
+	config.C.AuthRequired = []string{auth.READ}
+	config.C.Presets = map[string]string{"avatar": "30x30/crop/c/jpg"}
+	config.C.ThumborEnable = true
+	config.C.ThumborPrefix = "/thumbor"
+	config.C.ThumborUnsafe = true
+	config.C.IIIFEnable = true
+	config.C.IIIFPrefix = "/iiif"
+
+	api := newTestApi()
+	api.Auth = auth.New(map[string]*auth.Grant{
+		"reader": {Scopes: []string{auth.READ}, Prefixes: []string{"samuel-"}},
+	}, nil, nil)
+	api.Originals = &store.TwoTier{Store: store.NewFileStore("../testdata")}
+	api.Thumbnails = &store.NoopCache{}
+	api.Tiers = collections.NewSyncStrSet()
+	api.Etags = collections.NewSyncStrSet()
+	api.Router = mux.NewRouter()
+	api.initPresets()
+	api.routes()
+
+	// every route serving an original's pixels
+	urls := []string{
+		"/%s",
+		"/30x30/crop/c/%s",
+		"/30x30/crop/c/%s.webp",
+		"/%s?w=30",
+		"/p/avatar/%s",
+		"/thumbor/unsafe/30x20/%s",
+		"/iiif/%s/full/max/0/default.jpg",
+		"/iiif/%s/info.json",
+	}
+	tests := []struct {
+		original string
+		key      string
+		status   int
+	}{
+		{"samuel-clara-69657-unsplash.jpg", "", http.StatusUnauthorized},
+		{"samuel-clara-69657-unsplash.jpg", "reader", http.StatusOK},
+		{"natasha-kasim-708827-unsplash.jpg", "reader", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		for _, u := range urls {
+			u = fmt.Sprintf(u, test.original)
+			r := httptest.NewRequest("GET", u, nil)
+			if test.key != "" {
+				r.Header.Set("Authorization", "Bearer "+test.key)
+			}
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, r)
+			if w.Code != test.status {
+				t.Errorf("%s with key %q: expected status %d, got %d", u, test.key, test.status, w.Code)
+			}
+		}
+	}
+
+	// a known ETag doesn't skip the authentication
+	config.C.EtagCacheEnable = true
+	api.Etags.Add(`"known"`)
+	for _, u := range urls {
+		u = fmt.Sprintf(u, "samuel-clara-69657-unsplash.jpg")
+		r := httptest.NewRequest("GET", u, nil)
+		r.Header.Set("If-None-Match", `"known"`)
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s with a known ETag: expected status %d, got %d", u, http.StatusUnauthorized, w.Code)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/kxlt/imageresizer/imager"
+)
+
+// negotiable lists the output formats picked through the Accept header, in
+// order of preference. Anything else falls back to a format every client
+// decodes.
+var negotiable = []imager.ImageType{imager.AVIF, imager.WEBP}
+
+var extensions = map[imager.ImageType]string{
+	imager.JPEG: "jpg",
+	imager.PNG:  "png",
+	imager.WEBP: "webp",
+	imager.AVIF: "avif",
+	imager.GIF:  "gif",
+}
+
+// formats maps the extensions in pinned-format URLs to output formats.
+var formats = make(map[string]imager.ImageType)
+
+func init() {
+	for format, ext := range extensions {
+		formats[ext] = format
+	}
+}
+
+// negotiateFormat returns the preferred output format the client accepts, or
+// imager.UNKNOWN for a format every client decodes, the source format for
+// JPEG, PNG and GIF originals. Only explicit mime types count: wildcards such
+// as image/* are sent by clients that can't decode AVIF.
+func (api *Api) negotiateFormat(accept string) imager.ImageType {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		mimeType := strings.ToLower(strings.TrimSpace(params[0]))
+		accepted[mimeType] = acceptQuality(params[1:]) > 0
+	}
+	for _, format := range negotiable {
+		if accepted[mimeTypes[format]] && api.canEncode(format) {
+			return format
+		}
+	}
+	return imager.UNKNOWN
+}
+
+// canEncode reports whether the imager can encode thumbnails as format.
+func (api *Api) canEncode(format imager.ImageType) bool {
+	for _, supported := range api.Imager.SupportedFormats() {
+		if supported == format {
+			return true
+		}
+	}
+	return false
+}
+
+func acceptQuality(params []string) float64 {
+	for _, param := range params {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "q=") {
+			q, err := strconv.ParseFloat(param[2:], 64)
+			if err != nil {
+				return 0
+			}
+			return q
+		}
+	}
+	return 1
+}
+
+// formatSuffix returns the suffix added to the thumbnail cache key so every
+// output format of a thumbnail is stored separately.
+func formatSuffix(format imager.ImageType) string {
+	if format == imager.UNKNOWN {
+		return ""
+	}
+	return "." + extensions[format]
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"testing"
+
+	"github.com/kxlt/imageresizer/imager"
+)
+
+// testImager resizes with the imager of the build, but encodes every format
+// so tests don't depend on how libvips was built.
+type testImager struct {
+	imager.Imager
+}
+
+func (testImager) SupportedFormats() []imager.ImageType {
+	return []imager.ImageType{imager.JPEG, imager.PNG, imager.WEBP, imager.AVIF, imager.GIF}
+}
+
+func newTestApi() *Api {
+	return &Api{Imager: testImager{imager.New(imagerConfig())}}
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	api := newTestApi()
+	tests := []struct {
+		accept string
+		format imager.ImageType
+	}{
+		{"", imager.UNKNOWN},
+		{"*/*", imager.UNKNOWN},
+		{"image/*,*/*;q=0.8", imager.UNKNOWN},
+		{"image/webp,image/apng,image/*,*/*;q=0.8", imager.WEBP},
+		{"image/avif,image/webp,image/apng,image/*,*/*;q=0.8", imager.AVIF},
+		{"image/webp;q=0, image/png", imager.UNKNOWN},
+		{"image/avif;q=0,image/webp;q=0.5", imager.WEBP},
+		{"IMAGE/WEBP", imager.WEBP},
+	}
+	for _, test := range tests {
+		if format := api.negotiateFormat(test.accept); format != test.format {
+			t.Errorf("%q: expected format %d, got %d", test.accept, test.format, format)
+		}
+	}
+}
+
+func TestParseParams_Format(t *testing.T) {
+	api := newTestApi()
+	vars := map[string]string{
+		"width":    "300",
+		"height":   "200",
+		"resizeOp": "crop",
+		"options":  "s",
+		"path":     "photo.jpg",
+		"format":   "webp",
+	}
+	options, err := api.parseParams(vars)
+	if err != nil || options.Format != imager.WEBP {
+		t.Errorf("expected WEBP output format, got %d (%v)", options.Format, err)
+	}
+	vars["format"] = "tiff"
+	if _, err := api.parseParams(vars); err == nil {
+		t.Errorf("expected error for unsupported format")
+	}
+	delete(vars, "format")
+	options, err = api.parseParams(vars)
+	if err != nil || options.Format != imager.UNKNOWN {
+		t.Errorf("expected source output format, got %d (%v)", options.Format, err)
+	}
+}
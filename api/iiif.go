@@ -0,0 +1,359 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/config"
+	"github.com/kxlt/imageresizer/imager"
+	"github.com/rcrowley/go-metrics"
+)
+
+// IIIF Image API 3.0 URLs are
+// {prefix}/{identifier}/{region}/{size}/{rotation}/{quality}.{format} and
+// {prefix}/{identifier}/info.json, identifier being the URL-encoded path of an
+// original. See https://iiif.io/api/image/3.0/
+const iiifContext = "http://iiif.io/api/image/3/context.json"
+
+var (
+	iiifPixelRegionRegexp   = regexp.MustCompile("^([0-9]+),([0-9]+),([0-9]+),([0-9]+)$")
+	iiifPercentRegionRegexp = regexp.MustCompile("^pct:([0-9.]+),([0-9.]+),([0-9.]+),([0-9.]+)$")
+	iiifSizeRegexp          = regexp.MustCompile("^(!?)([0-9]*),([0-9]*)$")
+	iiifRotationRegexp      = regexp.MustCompile("^(!?)(0|90|180|270)$")
+)
+
+var iiifQualities = map[string]imager.ColorModeType{
+	"default": imager.COLOR,
+	"color":   imager.COLOR,
+	"gray":    imager.GRAY,
+	"bitonal": imager.BITONAL,
+}
+
+// iiifInfo is the image information document, info.json
+type iiifInfo struct {
+	Context        string   `json:"@context"`
+	ID             string   `json:"id"`
+	Type           string   `json:"type"`
+	Protocol       string   `json:"protocol"`
+	Profile        string   `json:"profile"`
+	Width          int      `json:"width"`
+	Height         int      `json:"height"`
+	MaxWidth       int      `json:"maxWidth,omitempty"`
+	MaxHeight      int      `json:"maxHeight,omitempty"`
+	MaxArea        int      `json:"maxArea,omitempty"`
+	ExtraQualities []string `json:"extraQualities"`
+	ExtraFormats   []string `json:"extraFormats,omitempty"`
+	ExtraFeatures  []string `json:"extraFeatures"`
+}
+
+func (api *Api) serveIIIF() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := metrics.GetOrRegisterTimer("api.iiif.latency", nil)
+		t.Time(func() {
+			vars := mux.Vars(r)
+			info, ok := api.probeOriginal(w, vars["identifier"])
+			if !ok {
+				return
+			}
+			resizeTier, options, err := api.iiifParams(vars, info)
+			if err != nil {
+				respondWithErr(w, http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			api.serveThumb(w, r, resizeTier, vars["identifier"], options, false)
+		})
+	}
+}
+
+func (api *Api) serveIIIFInfo() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := metrics.GetOrRegisterTimer("api.iiif.latency", nil)
+		t.Time(func() {
+			identifier := mux.Vars(r)["identifier"]
+			info, ok := api.probeOriginal(w, identifier)
+			if !ok {
+				return
+			}
+			scheme := "http"
+			if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+				scheme = "https"
+			}
+			doc := iiifInfo{
+				Context:        iiifContext,
+				ID:             scheme + "://" + r.Host + config.C.IIIFPrefix + "/" + url.PathEscape(identifier),
+				Type:           "ImageService3",
+				Protocol:       "http://iiif.io/api/image",
+				Profile:        "level2",
+				Width:          info.Width,
+				Height:         info.Height,
+				MaxWidth:       config.C.SizesMax,
+				MaxHeight:      config.C.SizesMax,
+				MaxArea:        config.C.IIIFMaxArea,
+				ExtraQualities: []string{"color", "gray", "bitonal"},
+				ExtraFeatures:  []string{"mirroring"},
+			}
+			// ^ sizes are only served up to a published limit
+			if iiifUpscaling() {
+				doc.ExtraFeatures = append(doc.ExtraFeatures, "sizeUpscaling")
+			}
+			// jpg and png are part of level2
+			for _, format := range []imager.ImageType{imager.WEBP, imager.AVIF, imager.GIF} {
+				if api.canEncode(format) {
+					doc.ExtraFormats = append(doc.ExtraFormats, extensions[format])
+				}
+			}
+			w.Header().Set("Content-Type", "application/ld+json;profile=\""+iiifContext+"\"")
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.WriteHeader(http.StatusOK)
+			json.NewEncoder(w).Encode(doc)
+		})
+	}
+}
+
+// redirectToIIIFInfo redirects the base URI of an image to its info.json
+func redirectToIIIFInfo(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, r.URL.EscapedPath()+"/info.json", http.StatusSeeOther)
+}
+
+// iiifInfoTier caches the size of the originals served through IIIF in the
+// thumbnail cache, so that cached images and info.json are served without
+// fetching and probing their original. It's removed with their thumbnails.
+const iiifInfoTier = "iiif/info"
+
+// probeOriginal returns the info of the original at path, the size only when
+// cached, or responds with the error and returns false.
+func (api *Api) probeOriginal(w http.ResponseWriter, path string) (imager.Info, bool) {
+	var info imager.Info
+	infoPath := iiifInfoTier + "/" + path
+	api.Tiers.Add(iiifInfoTier)
+	if buf, _ := api.Thumbnails.Get(infoPath); buf != nil {
+		if _, err := fmt.Sscanf(string(buf), "%dx%d", &info.Width, &info.Height); err == nil {
+			return info, true
+		}
+	}
+	buf, err := api.Originals.Get(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			respondWithErr(w, http.StatusNotFound)
+		} else {
+			respondWithErr(w, http.StatusInternalServerError)
+		}
+		return imager.Info{}, false
+	}
+	info, err = api.Imager.Probe(buf)
+	if err != nil {
+		respondWithImagerErr(w, err)
+		return imager.Info{}, false
+	}
+	go api.Thumbnails.Put(infoPath, []byte(fmt.Sprintf("%dx%d", info.Width, info.Height)))
+	return info, true
+}
+
+// iiifParams translates the route vars of a IIIF image request for an
+// original described by info into the resizeTier and options of its
+// thumbnail. Equivalent requests, e.g. full/max and 0,0,W,H/W,, share the
+// same resizeTier.
+func (api *Api) iiifParams(vars map[string]string, info imager.Info) (string, imager.Options, error) {
+	region, err := iiifRegion(vars["region"], info.Width, info.Height)
+	if err != nil {
+		return "", imager.Options{}, err
+	}
+	width, height, err := iiifSize(vars["size"], region)
+	if err != nil {
+		return "", imager.Options{}, err
+	}
+	if len(config.C.SizesAllowed) > 0 || config.C.SizesStep > 0 {
+		// every region would be a new tier, only whole images are bounded
+		if vars["region"] != "full" && vars["region"] != "square" {
+			return "", imager.Options{}, errors.New("region not allowed by sizes")
+		}
+		if w, h := allowedSize(width, height); w != width || h != height {
+			return "", imager.Options{}, errors.New("size not allowed by sizes")
+		}
+	}
+	rotation := iiifRotationRegexp.FindStringSubmatch(vars["rotation"])
+	if rotation == nil {
+		return "", imager.Options{}, errors.New("unsupported rotation")
+	}
+	angle, _ := strconv.Atoi(rotation[2])
+	quality := vars["quality"]
+	colorMode, ok := iiifQualities[quality]
+	if !ok {
+		return "", imager.Options{}, errors.New("invalid quality")
+	}
+	if quality == "color" {
+		quality = "default"
+	}
+	format, ok := formats[vars["format"]]
+	if !ok || !api.canEncode(format) {
+		return "", imager.Options{}, errors.New("unsupported format")
+	}
+
+	options := imager.Options{
+		Width:     width,
+		Height:    height,
+		ResizeOp:  imager.FILL,
+		Format:    format,
+		Flip:      rotation[1] == "!",
+		Rotate:    angle,
+		ColorMode: colorMode,
+	}
+	if region.Width != info.Width || region.Height != info.Height {
+		// the whole image is resized faster without a region
+		options.Region = region
+	}
+	resizeTier := fmt.Sprintf("iiif/%d,%d,%d,%d/%d,%d/%s/%s",
+		region.X,
+		region.Y,
+		region.Width,
+		region.Height,
+		width,
+		height,
+		vars["rotation"],
+		quality)
+	return resizeTier, options, nil
+}
+
+// iiifRegion parses the region of a IIIF image request, full, square, x,y,w,h
+// or pct:x,y,w,h, and returns it clipped to the width x height image.
+func iiifRegion(region string, width int, height int) (imager.Region, error) {
+	var r imager.Region
+	switch {
+	case region == "full":
+		return imager.Region{Width: width, Height: height}, nil
+	case region == "square":
+		side := width
+		if height < side {
+			side = height
+		}
+		return imager.Region{X: (width - side) / 2, Y: (height - side) / 2, Width: side, Height: side}, nil
+	case iiifPixelRegionRegexp.MatchString(region):
+		match := iiifPixelRegionRegexp.FindStringSubmatch(region)
+		r.X, _ = strconv.Atoi(match[1])
+		r.Y, _ = strconv.Atoi(match[2])
+		r.Width, _ = strconv.Atoi(match[3])
+		r.Height, _ = strconv.Atoi(match[4])
+	case iiifPercentRegionRegexp.MatchString(region):
+		match := iiifPercentRegionRegexp.FindStringSubmatch(region)
+		var pct [4]float64
+		for i := range pct {
+			var err error
+			if pct[i], err = strconv.ParseFloat(match[i+1], 64); err != nil {
+				return imager.Region{}, errors.New("invalid region")
+			}
+		}
+		r.X = iiifRound(pct[0] * float64(width) / 100)
+		r.Y = iiifRound(pct[1] * float64(height) / 100)
+		r.Width = iiifRound(pct[2] * float64(width) / 100)
+		r.Height = iiifRound(pct[3] * float64(height) / 100)
+	default:
+		return imager.Region{}, errors.New("invalid region")
+	}
+	if r.Width <= 0 || r.Height <= 0 || r.X >= width || r.Y >= height {
+		return imager.Region{}, errors.New("region outside of the image")
+	}
+	if r.X+r.Width > width {
+		r.Width = width - r.X
+	}
+	if r.Y+r.Height > height {
+		r.Height = height - r.Y
+	}
+	return r, nil
+}
+
+// iiifSize parses the size of a IIIF image request, max, w,, ,h, pct:n, w,h
+// or !w,h, each optionally prefixed with ^ to allow upscaling, and returns
+// the size region is scaled to. Sizes above sizes.max or iiif.maxarea, when
+// set, are rejected.
+func iiifSize(size string, region imager.Region) (int, int, error) {
+	upscale := strings.HasPrefix(size, "^")
+	if upscale && !iiifUpscaling() {
+		return 0, 0, errors.New("upscaling without a size limit")
+	}
+	size = strings.TrimPrefix(size, "^")
+	var width, height int
+	switch {
+	case size == "max":
+		width, height = region.Width, region.Height
+		if max := config.C.SizesMax; max > 0 {
+			width, height = iiifConfine(region, max, max, upscale)
+		}
+		if maxArea := config.C.IIIFMaxArea; maxArea > 0 {
+			// rounded down to stay within the area
+			scale := math.Sqrt(float64(maxArea) / (float64(width) * float64(height)))
+			if scale < 1 || upscale && config.C.SizesMax == 0 {
+				width, height = int(scale*float64(width)), int(scale*float64(height))
+			}
+		}
+	case strings.HasPrefix(size, "pct:"):
+		pct, err := strconv.ParseFloat(strings.TrimPrefix(size, "pct:"), 64)
+		if err != nil {
+			return 0, 0, errors.New("invalid size")
+		}
+		width = iiifRound(pct * float64(region.Width) / 100)
+		height = iiifRound(pct * float64(region.Height) / 100)
+	default:
+		match := iiifSizeRegexp.FindStringSubmatch(size)
+		if match == nil || match[2] == "" && match[3] == "" {
+			return 0, 0, errors.New("invalid size")
+		}
+		width, _ = strconv.Atoi(match[2])
+		height, _ = strconv.Atoi(match[3])
+		switch {
+		case match[1] == "!":
+			if match[2] == "" || match[3] == "" {
+				return 0, 0, errors.New("invalid size")
+			}
+			width, height = iiifConfine(region, width, height, upscale)
+		case match[3] == "":
+			height = iiifRound(float64(region.Height*width) / float64(region.Width))
+		case match[2] == "":
+			width = iiifRound(float64(region.Width*height) / float64(region.Height))
+		}
+	}
+	if width < 1 || height < 1 {
+		return 0, 0, errors.New("empty size")
+	}
+	if !upscale && (width > region.Width || height > region.Height) {
+		return 0, 0, errors.New("upscaling without ^")
+	}
+	if max := config.C.SizesMax; max > 0 && (width > max || height > max) {
+		return 0, 0, errors.New("size above sizes.max")
+	}
+	if maxArea := config.C.IIIFMaxArea; maxArea > 0 && int64(width)*int64(height) > int64(maxArea) {
+		return 0, 0, errors.New("size above iiif.maxarea")
+	}
+	return width, height, nil
+}
+
+// iiifUpscaling reports whether ^ sizes are allowed: only when sizes.max or
+// iiif.maxarea bounds them.
+func iiifUpscaling() bool {
+	return config.C.SizesMax > 0 || config.C.IIIFMaxArea > 0
+}
+
+// iiifConfine returns the size region is scaled to in order to fit in
+// width x height, keeping its aspect ratio, only enlarging it if upscale.
+func iiifConfine(region imager.Region, width int, height int, upscale bool) (int, int) {
+	scale := math.Min(
+		float64(width)/float64(region.Width),
+		float64(height)/float64(region.Height))
+	if scale > 1 && !upscale {
+		scale = 1
+	}
+	return iiifRound(scale * float64(region.Width)), iiifRound(scale * float64(region.Height))
+}
+
+func iiifRound(f float64) int {
+	return int(math.Round(f))
+}
@@ -0,0 +1,231 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/collections"
+	"github.com/kxlt/imageresizer/config"
+	"github.com/kxlt/imageresizer/imager"
+	"github.com/kxlt/imageresizer/store"
+)
+
+func TestIIIFRegion(t *testing.T) {
+	tests := []struct {
+		region string
+		valid  bool
+		r      imager.Region
+	}{
+		{"full", true, imager.Region{Width: 400, Height: 300}},
+		{"square", true, imager.Region{X: 50, Width: 300, Height: 300}},
+		{"10,20,100,50", true, imager.Region{X: 10, Y: 20, Width: 100, Height: 50}},
+		{"350,250,100,100", true, imager.Region{X: 350, Y: 250, Width: 50, Height: 50}},
+		{"pct:10,10,50,50.5", true, imager.Region{X: 40, Y: 30, Width: 200, Height: 152}},
+		{"400,0,10,10", false, imager.Region{}},
+		{"0,0,0,10", false, imager.Region{}},
+		{"-10,0,10,10", false, imager.Region{}},
+		{"pct:a,0,10,10", false, imager.Region{}},
+		{"center", false, imager.Region{}},
+	}
+	for _, test := range tests {
+		r, err := iiifRegion(test.region, 400, 300)
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: expected error", test.region)
+			}
+			continue
+		}
+		if err != nil || r != test.r {
+			t.Errorf("%s: expected %+v, got %+v (%v)", test.region, test.r, r, err)
+		}
+	}
+}
+
+func TestIIIFSize(t *testing.T) {
+	defer func(c config.Config) { config.C = c }(config.C)
+
+	region := imager.Region{Width: 400, Height: 300}
+	tests := []struct {
+		size    string
+		max     int
+		maxArea int
+		width   int
+		height  int
+	}{
+		{"max", 0, 0, 400, 300},
+		{"max", 200, 0, 200, 150},
+		{"max", 0, 30000, 200, 150},
+		{"max", 300, 30000, 200, 150},
+		{"^max", 800, 0, 800, 600},
+		{"^max", 0, 480000, 800, 600},
+		{"^max", 800, 120000, 400, 300},
+		{"200,", 0, 0, 200, 150},
+		{",150", 0, 0, 200, 150},
+		{"pct:25", 0, 0, 100, 75},
+		{"100,100", 0, 0, 100, 100},
+		{"!200,200", 0, 0, 200, 150},
+		{"!800,800", 0, 0, 400, 300},
+		{"^!800,800", 0, 480000, 800, 600},
+		{"^800,", 0, 480000, 800, 600},
+		{"^801,", 0, 480000, 0, 0},
+		// ^ sizes need a limit
+		{"^800,", 0, 0, 0, 0},
+		{"800,", 0, 0, 0, 0},
+		{"300,", 200, 0, 0, 0},
+		{"300,", 0, 30000, 0, 0},
+		{",", 0, 0, 0, 0},
+		{"!200,", 0, 0, 0, 0},
+		{"pct:0", 0, 0, 0, 0},
+		{"full", 0, 0, 0, 0},
+	}
+	for _, test := range tests {
+		config.C.SizesMax = test.max
+		config.C.IIIFMaxArea = test.maxArea
+		width, height, err := iiifSize(test.size, region)
+		if test.width == 0 {
+			if err == nil {
+				t.Errorf("%s with max %d and max area %d: expected error", test.size, test.max, test.maxArea)
+			}
+			continue
+		}
+		if err != nil || width != test.width || height != test.height {
+			t.Errorf("%s with max %d and max area %d: expected %dx%d, got %dx%d (%v)",
+				test.size, test.max, test.maxArea, test.width, test.height, width, height, err)
+		}
+	}
+}
+
+func TestServeIIIF(t *testing.T) {
+	defer func(c config.Config) { config.C = c }(config.C)
+	config.C.IIIFEnable = true
+	config.C.IIIFPrefix = "/iiif"
+	config.C.IIIFMaxArea = 1000000
+
+	api := newTestApi()
+	api.Originals = &store.TwoTier{Store: store.NewFileStore("../testdata")}
+	api.Thumbnails = &store.NoopCache{}
+	api.Tiers = collections.NewSyncStrSet()
+	api.Etags = collections.NewSyncStrSet()
+	api.Router = mux.NewRouter()
+	api.routes()
+
+	// 2400x1600
+	base := "/iiif/samuel-clara-69657-unsplash.jpg"
+	tests := []struct {
+		url    string
+		status int
+		width  int
+		height int
+	}{
+		{base + "/full/1300,/0/default.jpg", http.StatusBadRequest, 0, 0},
+		{base + "/0,0,300,200/30,/90/gray.png", http.StatusOK, 20, 30},
+		{base + "/square/^pct:1/!0/bitonal.jpg", http.StatusOK, 16, 16},
+		{base + "/full/5000,/0/default.jpg", http.StatusBadRequest, 0, 0},
+		{base + "/full/max/45/default.jpg", http.StatusBadRequest, 0, 0},
+		{base + "/full/max/0/sepia.jpg", http.StatusBadRequest, 0, 0},
+		{base + "/full/max/0/default.tif", http.StatusBadRequest, 0, 0},
+		{"/iiif/missing.jpg/full/max/0/default.jpg", http.StatusNotFound, 0, 0},
+		{base, http.StatusSeeOther, 0, 0},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.url, test.status, w.Code)
+			continue
+		}
+		if test.width == 0 {
+			continue
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(w.Body.Bytes()))
+		if err != nil || cfg.Width != test.width || cfg.Height != test.height {
+			t.Errorf("%s: expected %dx%d, got %dx%d (%v)", test.url, test.width, test.height, cfg.Width, cfg.Height, err)
+		}
+	}
+	if !api.Tiers.Contains("iiif/0,0,300,200/30,20/90/gray") {
+		t.Errorf("IIIF image not cached under its canonical tier")
+	}
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", base+"/info.json", nil))
+	var info iiifInfo
+	if err := json.NewDecoder(w.Body).Decode(&info); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("info.json: expected status 200, got %d (%v)", w.Code, err)
+	}
+	if info.ID != "http://example.com"+base || info.Width != 2400 || info.Height != 1600 ||
+		info.MaxArea != 1000000 || info.ExtraFeatures[len(info.ExtraFeatures)-1] != "sizeUpscaling" {
+		t.Errorf("info.json: unexpected %+v", info)
+	}
+}
+
+func TestServeIIIF_CachedInfo(t *testing.T) {
+	defer func(c config.Config) { config.C = c }(config.C)
+	config.C.IIIFEnable = true
+	config.C.IIIFPrefix = "/iiif"
+
+	originals := &countingStore{Store: store.NewFileStore("../testdata")}
+	api := newTestApi()
+	api.Originals = &store.TwoTier{Store: originals}
+	api.Thumbnails = mapCache{
+		iiifInfoTier + "/samuel-clara-69657-unsplash.jpg":                        []byte("2400x1600"),
+		"iiif/0,0,2400,1600/30,20/0/default/samuel-clara-69657-unsplash.jpg.jpg": []byte("cached"),
+	}
+	api.Tiers = collections.NewSyncStrSet()
+	api.Etags = collections.NewSyncStrSet()
+	api.Router = mux.NewRouter()
+	api.routes()
+
+	for _, url := range []string{
+		"/iiif/samuel-clara-69657-unsplash.jpg/info.json",
+		"/iiif/samuel-clara-69657-unsplash.jpg/full/30,/0/default.jpg",
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", url, w.Code)
+		}
+	}
+	if originals.gets != 0 {
+		t.Errorf("expected cached info and thumbnails not to fetch the original, got %d fetches", originals.gets)
+	}
+}
+
+func TestServeIIIF_Sizes(t *testing.T) {
+	defer func(c config.Config) { config.C = c }(config.C)
+	config.C.IIIFEnable = true
+	config.C.IIIFPrefix = "/iiif"
+	config.C.SizesStep = 10
+
+	api := newTestApi()
+	api.Originals = &store.TwoTier{Store: store.NewFileStore("../testdata")}
+	api.Thumbnails = &store.NoopCache{}
+	api.Tiers = collections.NewSyncStrSet()
+	api.Etags = collections.NewSyncStrSet()
+	api.Router = mux.NewRouter()
+	api.routes()
+
+	// 2400x1600
+	base := "/iiif/samuel-clara-69657-unsplash.jpg"
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{base + "/full/30,/0/default.jpg", http.StatusOK},
+		{base + "/square/30,30/0/default.jpg", http.StatusOK},
+		{base + "/full/31,/0/default.jpg", http.StatusBadRequest},
+		{base + "/full/pct:1/0/default.jpg", http.StatusBadRequest},
+		{base + "/0,0,300,200/30,/0/default.jpg", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.url, test.status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/imager"
+	"github.com/rcrowley/go-metrics"
+)
+
+// metadataSuffix is appended to the path of an original to store its
+// metadata next to it, e.g. photo.jpg.meta.json
+const metadataSuffix = ".meta.json"
+
+// metadataMaxSize is the size limit of metadata documents
+const metadataMaxSize = 64 * 1024
+
+// focalGravity is the gravity reading the focal point and crop box from the
+// metadata of the original
+const focalGravity = "focal"
+
+// metadata is the document editors set once per original, so URLs don't need
+// to repeat its focal point.
+type metadata struct {
+	// Focal is relative to the width and height of the original, 0-1
+	Focal *focalPoint `json:"focal,omitempty"`
+	// Crop is the area focal crops keep in view, in pixels of the original
+	Crop *cropBox `json:"crop,omitempty"`
+	Alt  string   `json:"alt,omitempty"`
+}
+
+type focalPoint struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+type cropBox struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// parseMetadata decodes and validates a metadata document
+func parseMetadata(buf []byte) (*metadata, error) {
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.DisallowUnknownFields()
+	meta := &metadata{}
+	if err := decoder.Decode(meta); err != nil {
+		return nil, err
+	}
+	if f := meta.Focal; f != nil && (f.X < 0 || f.X > 1 || f.Y < 0 || f.Y > 1) {
+		return nil, errors.New("invalid focal point")
+	}
+	if c := meta.Crop; c != nil && (c.X < 0 || c.Y < 0 || c.Width < 1 || c.Height < 1) {
+		return nil, errors.New("invalid crop box")
+	}
+	return meta, nil
+}
+
+// usesMetadata reports whether the options of a thumbnail path read the
+// metadata of the original, i.e. whether it's cropped at the focal gravity.
+func usesMetadata(resizeOp string, options string) bool {
+	return resizeOp == "crop" && strings.SplitN(options, ",", 2)[0] == focalGravity
+}
+
+// withMetadata returns options with the focal point of the metadata of the
+// original at path, srcBuf, moved as little as needed for the crop to show the
+// whole crop box, or only the box when the crop is smaller than it. A rect
+// source crop takes precedence over the box, the focal point is then made
+// relative to it. Without metadata thumbnails are centered.
+func (api *Api) withMetadata(path string, srcBuf []byte, options imager.Options) (imager.Options, error) {
+	buf, err := api.Originals.Get(path + metadataSuffix)
+	if os.IsNotExist(err) {
+		return options, nil
+	}
+	if err != nil {
+		return options, err
+	}
+	meta, err := parseMetadata(buf)
+	if err != nil {
+		return options, err
+	}
+	info, err := api.Imager.Probe(srcBuf)
+	if err != nil {
+		return options, err
+	}
+	region := options.Region
+	if region.Empty() {
+		region = imager.Region{Width: info.Width, Height: info.Height}
+	}
+	// in pixels of the original
+	x := float64(region.X) + options.FocalX*float64(region.Width)
+	y := float64(region.Y) + options.FocalY*float64(region.Height)
+	if meta.Focal != nil {
+		x, y = meta.Focal.X*float64(info.Width), meta.Focal.Y*float64(info.Height)
+	}
+	if options.Region.Empty() && meta.Crop != nil {
+		width, height := cropWindow(options, info.Width, info.Height)
+		x = coverCenter(x, meta.Crop.X, meta.Crop.Width, width)
+		y = coverCenter(y, meta.Crop.Y, meta.Crop.Height, height)
+	}
+	options.FocalX = (x - float64(region.X)) / float64(region.Width)
+	options.FocalY = (y - float64(region.Y)) / float64(region.Height)
+	return options, nil
+}
+
+// cropWindow returns the size of the area of a width x height original kept by
+// a crop to the size of options.
+func cropWindow(options imager.Options, width int, height int) (float64, float64) {
+	cropWidth, cropHeight := float64(options.Width), float64(options.Height)
+	if options.NoEnlarge {
+		cropWidth = math.Min(cropWidth, float64(width))
+		cropHeight = math.Min(cropHeight, float64(height))
+	}
+	scale := math.Max(cropWidth/float64(width), cropHeight/float64(height))
+	return cropWidth / scale, cropHeight / scale
+}
+
+// coverCenter returns center moved as little as needed for a window of length
+// centered on it to cover the box from start to start+size, or to stay within
+// the box when it's longer than the window.
+func coverCenter(center float64, start int, size int, window float64) float64 {
+	low := float64(start+size) - window/2
+	high := float64(start) + window/2
+	if low > high {
+		low, high = high, low
+	}
+	return math.Max(low, math.Min(high, center))
+}
+
+func (api *Api) serveMetadata() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := metrics.GetOrRegisterTimer("api.metadata.latency", nil)
+		t.Time(func() {
+			buf, err := api.Originals.Get(mux.Vars(r)["path"] + metadataSuffix)
+			if err != nil {
+				if os.IsNotExist(err) {
+					respondWithErr(w, http.StatusNotFound)
+				} else {
+					respondWithErr(w, http.StatusInternalServerError)
+				}
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(buf)
+		})
+	}
+}
+
+// handleMetadataPuts stores the metadata of an existing original, whose crop
+// box must lie within it, and removes its thumbnails, which may have been
+// cropped with the previous one.
+func (api *Api) handleMetadataPuts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := mux.Vars(r)["path"]
+		buf, err := ioutil.ReadAll(io.LimitReader(r.Body, metadataMaxSize+1))
+		if err != nil {
+			respondWithErr(w, http.StatusBadRequest)
+			return
+		}
+		if len(buf) > metadataMaxSize {
+			respondWithErr(w, http.StatusRequestEntityTooLarge)
+			return
+		}
+		meta, err := parseMetadata(buf)
+		if err != nil {
+			respondWithErr(w, http.StatusBadRequest)
+			return
+		}
+		srcBuf, err := api.Originals.Get(path)
+		if err != nil {
+			respondWithErr(w, http.StatusNotFound)
+			return
+		}
+		if c := meta.Crop; c != nil {
+			info, err := api.Imager.Probe(srcBuf)
+			if err != nil {
+				respondWithImagerErr(w, err)
+				return
+			}
+			if c.X+c.Width > info.Width || c.Y+c.Height > info.Height {
+				respondWithErr(w, http.StatusBadRequest)
+				return
+			}
+		}
+		buf, _ = json.Marshal(meta)
+		if err := api.Originals.Put(path+metadataSuffix, buf); err != nil {
+			respondWithErr(w, http.StatusInternalServerError)
+			return
+		}
+		api.removeThumbnails(path)
+		respondWithStatusCode(w, http.StatusNoContent)
+	}
+}
+
+func (api *Api) handleMetadataDeletes() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := mux.Vars(r)["path"]
+		if err := api.Originals.Remove(path + metadataSuffix); err != nil {
+			respondWithErr(w, http.StatusNotFound)
+			return
+		}
+		api.removeThumbnails(path)
+		respondWithStatusCode(w, http.StatusNoContent)
+	}
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/collections"
+	"github.com/kxlt/imageresizer/config"
+	"github.com/kxlt/imageresizer/etag"
+	"github.com/kxlt/imageresizer/imager"
+	"github.com/kxlt/imageresizer/store"
+)
+
+// newMetadataTestApi returns an Api storing originals in a temporary copy of
+// the 2400x1600 test photo as photo.jpg
+func newMetadataTestApi(t *testing.T) (*Api, string) {
+	tmpdir, err := ioutil.TempDir("../testdata", t.Name())
+	if err != nil {
+		t.Fatalf("Could not create temp dir")
+	}
+	buf, err := ioutil.ReadFile("../testdata/samuel-clara-69657-unsplash.jpg")
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	if err := ioutil.WriteFile(path.Join(tmpdir, "photo.jpg"), buf, 0644); err != nil {
+		t.Fatalf("Could not write test file")
+	}
+	api := newTestApi()
+	api.Originals = &store.TwoTier{Store: store.NewFileStore(tmpdir)}
+	api.Thumbnails = &store.NoopCache{}
+	api.Tiers = collections.NewSyncStrSet()
+	api.Etags = collections.NewSyncStrSet()
+	api.Router = mux.NewRouter()
+	api.routes()
+	return api, tmpdir
+}
+
+func TestParseMetadata(t *testing.T) {
+	meta, err := parseMetadata([]byte(`{"focal": {"x": 0.3, "y": 1}, "crop": {"x": 0, "y": 10, "width": 100, "height": 50}, "alt": "A cat"}`))
+	expected := &metadata{
+		Focal: &focalPoint{X: 0.3, Y: 1},
+		Crop:  &cropBox{Y: 10, Width: 100, Height: 50},
+		Alt:   "A cat",
+	}
+	if err != nil || !reflect.DeepEqual(meta, expected) {
+		t.Errorf("expected %+v, got %+v (%v)", expected, meta, err)
+	}
+
+	for _, invalid := range []string{
+		``,
+		`[]`,
+		`{"focal": {"x": 1.5, "y": 0}}`,
+		`{"focal": {"x": 0.5, "y": -0.1}}`,
+		`{"crop": {"x": -1, "y": 0, "width": 10, "height": 10}}`,
+		`{"crop": {"x": 0, "y": 0, "width": 0, "height": 10}}`,
+		`{"caption": "unknown"}`,
+	} {
+		if _, err := parseMetadata([]byte(invalid)); err == nil {
+			t.Errorf("%s: expected error", invalid)
+		}
+	}
+}
+
+func TestWithMetadata(t *testing.T) {
+	api, tmpdir := newMetadataTestApi(t)
+	defer os.RemoveAll(tmpdir)
+	srcBuf, _ := api.Originals.Get("photo.jpg")
+
+	// photo.jpg is 2400x1600
+	box := `"crop": {"x": 1200, "y": 0, "width": 1200, "height": 1600}`
+	tests := []struct {
+		meta     string
+		width    int
+		height   int
+		rect     imager.Region
+		expected imager.Options
+	}{
+		{``, 30, 20, imager.Region{}, imager.Options{FocalX: 0.5, FocalY: 0.5}},
+		{`{"focal": {"x": 0.75, "y": 0.25}}`, 30, 20, imager.Region{}, imager.Options{FocalX: 0.75, FocalY: 0.25}},
+		// a 1600x1600 crop is moved right to show the whole box
+		{`{"focal": {"x": 0.5, "y": 0.5}, ` + box + `}`, 20, 20, imager.Region{},
+			imager.Options{FocalX: 1600.0 / 2400, FocalY: 0.5}},
+		{`{"focal": {"x": 0.75, "y": 0.5}, ` + box + `}`, 20, 20, imager.Region{},
+			imager.Options{FocalX: 0.75, FocalY: 0.5}},
+		// an 800x1600 crop stays within the box
+		{`{"focal": {"x": 0.25, "y": 0.5}, ` + box + `}`, 10, 20, imager.Region{},
+			imager.Options{FocalX: 1600.0 / 2400, FocalY: 0.5}},
+		{`{` + box + `}`, 30, 20, imager.Region{}, imager.Options{FocalX: 0.5, FocalY: 0.5}},
+		// the rect source crop takes precedence over the crop box
+		{`{"focal": {"x": 0.25, "y": 0.25}, ` + box + `}`, 30, 20, imager.Region{Width: 1200, Height: 800},
+			imager.Options{FocalX: 0.5, FocalY: 0.5, Region: imager.Region{Width: 1200, Height: 800}}},
+	}
+	for _, test := range tests {
+		os.Remove(path.Join(tmpdir, "photo.jpg"+metadataSuffix))
+		if test.meta != "" {
+			api.Originals.Put("photo.jpg"+metadataSuffix, []byte(test.meta))
+		}
+		options := imager.Options{Width: test.width, Height: test.height,
+			Gravity: imager.FOCAL, FocalX: 0.5, FocalY: 0.5, Region: test.rect}
+		options, err := api.withMetadata("photo.jpg", srcBuf, options)
+		test.expected.Width, test.expected.Height = test.width, test.height
+		test.expected.Gravity = imager.FOCAL
+		if err != nil || !reflect.DeepEqual(options, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v (%v)", test.meta, test.expected, options, err)
+		}
+	}
+}
+
+func TestMetadataHandlers(t *testing.T) {
+	defer func(enable bool) { config.C.EtagCacheEnable = enable }(config.C.EtagCacheEnable)
+	config.C.EtagCacheEnable = true
+
+	api, tmpdir := newMetadataTestApi(t)
+	defer os.RemoveAll(tmpdir)
+	// not goroutine-safe, but no thumbnails are created until it's replaced
+	cache := mapCache{}
+	api.Thumbnails = cache
+
+	thumbPath := "30x20/crop/focal/photo.jpg.jpg"
+	invalidate := func() {
+		api.Tiers.Add("30x20/crop/focal")
+		api.Thumbnails.Put(thumbPath, []byte("thumbnail"))
+		api.Etags.Add(etag.Generate([]byte("thumbnail"), true))
+	}
+	invalidated := func() bool {
+		_, cached := cache[thumbPath]
+		return !cached && !api.Etags.Contains(etag.Generate([]byte("thumbnail"), true))
+	}
+
+	doc := `{"focal":{"x":0.3,"y":0.6},"alt":"A cat"}`
+	tests := []struct {
+		method     string
+		url        string
+		body       string
+		status     int
+		invalidate bool
+	}{
+		{"GET", "/photo.jpg" + metadataSuffix, "", http.StatusNotFound, false},
+		{"PUT", "/photo.jpg" + metadataSuffix, doc, http.StatusNoContent, true},
+		{"GET", "/photo.jpg" + metadataSuffix, "", http.StatusOK, false},
+		{"PUT", "/photo.jpg" + metadataSuffix, `{"focal":{"x":2,"y":0}}`, http.StatusBadRequest, false},
+		{"PUT", "/photo.jpg" + metadataSuffix, `{"caption":"A cat"}`, http.StatusBadRequest, false},
+		{"PUT", "/photo.jpg" + metadataSuffix, `{"crop":{"x":2000,"y":0,"width":800,"height":600}}`,
+			http.StatusBadRequest, false},
+		{"PUT", "/missing.jpg" + metadataSuffix, doc, http.StatusNotFound, false},
+		{"POST", "/photo.jpg" + metadataSuffix, doc, http.StatusBadRequest, false},
+		{"DELETE", "/photo.jpg" + metadataSuffix, "", http.StatusNoContent, true},
+		{"GET", "/photo.jpg" + metadataSuffix, "", http.StatusNotFound, false},
+	}
+	for _, test := range tests {
+		if test.invalidate {
+			invalidate()
+		}
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(test.method, test.url, strings.NewReader(test.body)))
+		if w.Code != test.status {
+			t.Errorf("%s %s: expected status %d, got %d", test.method, test.url, test.status, w.Code)
+		}
+		if test.invalidate && !invalidated() {
+			t.Errorf("%s %s: thumbnails not invalidated", test.method, test.url)
+		}
+		if test.method == "GET" && w.Code == http.StatusOK {
+			var meta metadata
+			if err := json.NewDecoder(w.Body).Decode(&meta); err != nil || meta.Alt != "A cat" {
+				t.Errorf("%s %s: unexpected metadata %+v (%v)", test.method, test.url, meta, err)
+			}
+		}
+	}
+
+	api.Thumbnails = &store.NoopCache{}
+	api.Originals.Put("photo.jpg"+metadataSuffix, []byte(doc))
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/30x20/crop/focal/photo.jpg", nil))
+	if w.Code != http.StatusOK || !bytes.HasPrefix(w.Body.Bytes(), []byte{0xFF, 0xD8}) {
+		t.Errorf("expected a focal thumbnail, got status %d", w.Code)
+	}
+
+	// a corrupt sidecar isn't a missing original
+	api.Originals.Put("photo.jpg"+metadataSuffix, []byte("{"))
+	for url, status := range map[string]int{
+		"/30x20/crop/focal/photo.jpg":   http.StatusInternalServerError,
+		"/30x20/crop/focal/missing.jpg": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != status {
+			t.Errorf("%s: expected status %d, got %d", url, status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/config"
+	"github.com/kxlt/imageresizer/imager"
+	"github.com/rcrowley/go-metrics"
+)
+
+type preset struct {
+	definition string
+	tier       string // see presetTier
+	options    imager.Options
+	meta       bool // see usesMetadata
+}
+
+// presetTier returns the tier the thumbnails of a preset are cached under,
+// its name and a hash of its definition, e.g. avatar@1a2b3c4d. Thumbnails
+// made with a previous definition are never served, they're under another
+// tier.
+func presetTier(name string, definition string) string {
+	sum := sha256.Sum256([]byte(definition))
+	return name + "@" + hex.EncodeToString(sum[:4])
+}
+
+// initPresets parses the presets in the config.
+func (api *Api) initPresets() {
+	api.presets = make(map[string]*preset)
+	for name, definition := range config.C.Presets {
+		options, err := api.parsePreset(definition)
+		if err != nil {
+			log.Fatalf("Invalid preset %s: %v\n", name, err)
+		}
+		parts := strings.Split(definition, "/")
+		api.presets[name] = &preset{
+			definition: definition,
+			tier:       presetTier(name, definition),
+			options:    options,
+			meta:       usesMetadata(parts[1], parts[2]),
+		}
+	}
+}
+
+// parsePreset parses a preset definition, {width}x{height}/{resizeOp}/{options}
+// optionally followed by /{format}, the same way as the thumbnail URLs.
+func (api *Api) parsePreset(definition string) (imager.Options, error) {
+	parts := strings.Split(definition, "/")
+	if len(parts) != 3 && len(parts) != 4 {
+		return imager.Options{}, errors.New("invalid preset definition")
+	}
+	size := strings.Split(parts[0], "x")
+	if len(size) > 2 {
+		return imager.Options{}, errors.New("invalid preset size")
+	}
+	for _, dimension := range size {
+		if n, err := strconv.Atoi(dimension); err != nil || n < 1 {
+			return imager.Options{}, errors.New("invalid preset size")
+		}
+	}
+	vars := map[string]string{
+		"width":    size[0],
+		"height":   size[len(size)-1],
+		"resizeOp": parts[1],
+		"options":  parts[2],
+	}
+	if len(parts) == 4 {
+		vars["format"] = parts[3]
+	}
+	return api.parseParams(vars)
+}
+
+// stalePresetThumbnail reports whether filename, in the thumbnail cache, was
+// made with a previous definition of its preset, or a preset that was removed.
+func (api *Api) stalePresetThumbnail(filename string) bool {
+	tier := strings.SplitN(filename, "/", 2)[0]
+	i := strings.LastIndex(tier, "@")
+	if i < 0 {
+		return false
+	}
+	preset, ok := api.presets[tier[:i]]
+	return !ok || preset.tier != tier
+}
+
+// presetPinsFormat reports whether the preset requested by r pins the output
+// format, see varyMiddleware. Unknown presets are 404s without Vary.
+func (api *Api) presetPinsFormat(r *http.Request) bool {
+	preset, ok := api.presets[mux.Vars(r)["preset"]]
+	return !ok || preset.options.Format != imager.UNKNOWN
+}
+
+func (api *Api) servePresets() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := metrics.GetOrRegisterTimer("api.presets.latency", nil)
+		t.Time(func() {
+			vars := mux.Vars(r)
+			preset, ok := api.presets[vars["preset"]]
+			if !ok {
+				respondWithErr(w, http.StatusNotFound)
+				return
+			}
+			api.serveThumb(w, r, preset.tier, vars["path"], preset.options, preset.meta)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"bytes"
+	"image"
+	_ "image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/collections"
+	"github.com/kxlt/imageresizer/config"
+	"github.com/kxlt/imageresizer/imager"
+	"github.com/kxlt/imageresizer/store"
+)
+
+func init() {
+	config.RefreshConfig()
+}
+
+func TestParsePreset(t *testing.T) {
+	api := newTestApi()
+	options, err := api.parsePreset("480x640/crop/s,q75/webp")
+	expected := imager.Options{
+		Width:    480,
+		Height:   640,
+		ResizeOp: imager.CROP,
+		Gravity:  imager.SMART,
+		Quality:  75,
+		Format:   imager.WEBP,
+	}
+	if err != nil || options.Width != expected.Width || options.Height != expected.Height ||
+		options.ResizeOp != expected.ResizeOp || options.Gravity != expected.Gravity ||
+		options.Quality != expected.Quality || options.Format != expected.Format {
+		t.Errorf("expected %+v, got %+v (%v)", expected, options, err)
+	}
+	options, err = api.parsePreset("300/fit/ffffff")
+	if err != nil || options.Width != 300 || options.Height != 300 || len(options.ExtendBackground) != 3 {
+		t.Errorf("unexpected options %+v (%v)", options, err)
+	}
+
+	for _, definition := range []string{
+		"",
+		"480x640/crop",
+		"480x640/crop/s/webp/extra",
+		"0x640/crop/s",
+		"480x640x1/crop/s",
+		"480x640/zoom/s",
+		"480x640/crop/s/tiff",
+	} {
+		if _, err := api.parsePreset(definition); err == nil {
+			t.Errorf("%q: expected error", definition)
+		}
+	}
+}
+
+// mapCache is an in-memory store.Cache.
+type mapCache map[string][]byte
+
+func (c mapCache) Get(filename string) ([]byte, error)   { return c[filename], nil }
+func (c mapCache) Put(filename string, buf []byte) error { c[filename] = buf; return nil }
+func (c mapCache) Remove(filename string) error          { delete(c, filename); return nil }
+func (c mapCache) PruneCache() error                     { return nil }
+func (c mapCache) LoadCache(walkFn func(item interface{}) error) error {
+	for filename := range c {
+		if err := walkFn(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestStalePresetThumbnail(t *testing.T) {
+	api := newTestApi()
+	api.presets = map[string]*preset{
+		"avatar": {definition: "200x200/crop/s", tier: presetTier("avatar", "200x200/crop/s")},
+	}
+	if presetTier("avatar", "200x200/crop/s") == presetTier("avatar", "100x100/crop/s") {
+		t.Errorf("expected a new tier when the definition changes")
+	}
+	tests := []struct {
+		filename string
+		stale    bool
+	}{
+		{presetTier("avatar", "200x200/crop/s") + "/photo.jpg", false},
+		{presetTier("avatar", "100x100/crop/s") + "/photo.jpg", true},
+		{presetTier("hero", "1200x400/crop/c") + "/dir/photo.jpg", true},
+		{"300x300/crop/s/photo.jpg", false},
+		{"iiif/0,0,300,200/30,20/0/default/photo.jpg", false},
+	}
+	for _, test := range tests {
+		if stale := api.stalePresetThumbnail(test.filename); stale != test.stale {
+			t.Errorf("%s: expected stale=%v", test.filename, test.stale)
+		}
+	}
+}
+
+func TestServePresets(t *testing.T) {
+	defer func(presets map[string]string) { config.C.Presets = presets }(config.C.Presets)
+	config.C.Presets = map[string]string{"avatar": "100x100/crop/c/jpg"}
+
+	api := newTestApi()
+	api.Originals = &store.TwoTier{Store: store.NewFileStore("../testdata")}
+	api.Thumbnails = &store.NoopCache{}
+	api.Tiers = collections.NewSyncStrSet()
+	api.Etags = collections.NewSyncStrSet()
+	api.Router = mux.NewRouter()
+	api.initPresets()
+	api.routes()
+
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"/p/avatar/samuel-clara-69657-unsplash.jpg", http.StatusOK},
+		{"/p/banner/samuel-clara-69657-unsplash.jpg", http.StatusNotFound},
+		{"/p/avatar/missing.jpg", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.url, test.status, w.Code)
+			continue
+		}
+		if w.Code != http.StatusOK {
+			continue
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(w.Body.Bytes()))
+		if err != nil || cfg.Width != 100 || cfg.Height != 100 {
+			t.Errorf("%s: expected a 100x100 thumbnail, got %dx%d (%v)", test.url, cfg.Width, cfg.Height, err)
+		}
+	}
+	if !api.Tiers.Contains(presetTier("avatar", "100x100/crop/c/jpg")) {
+		t.Errorf("preset tier not added to tiers")
+	}
+}
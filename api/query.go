@@ -0,0 +1,128 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/config"
+	"github.com/rcrowley/go-metrics"
+)
+
+var dimensionRegexp = regexp.MustCompile("^[1-9][0-9]*$")
+
+// hasTransformQuery matches requests for a thumbnail through the query string
+// API, e.g. /photo.jpg?w=300&h=200
+func hasTransformQuery(r *http.Request, rm *mux.RouteMatch) bool {
+	query := r.URL.Query()
+	return query.Get("w") != "" || query.Get("h") != ""
+}
+
+func (api *Api) serveQueryThumbs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := metrics.GetOrRegisterTimer("api.thumbs.latency", nil)
+		t.Time(func() {
+			vars, err := queryVars(r.URL.Query())
+			if err != nil {
+				respondWithErr(w, http.StatusBadRequest)
+				return
+			}
+			vars["path"] = mux.Vars(r)["path"]
+			api.serveTransform(w, r, vars, redirectToQuerySize)
+		})
+	}
+}
+
+// queryVars translates the query string API parameters into the route vars of
+// the equivalent thumbnail path, so both share the same cached thumbnails,
+// e.g. w=300&h=200&g=s&q=80&fmt=webp into 300x200/crop/s,q80 and webp, and
+// rect=x,y,w,h into the rect source crop and enlarge=0 into noenlarge.
+//
+// w and h default to each other, op to crop, g to c and bg to 0.
+func queryVars(query url.Values) (map[string]string, error) {
+	width, height := query.Get("w"), query.Get("h")
+	if width == "" {
+		width = height
+	}
+	if height == "" {
+		height = width
+	}
+	if !dimensionRegexp.MatchString(width) || !dimensionRegexp.MatchString(height) {
+		return nil, errors.New("invalid size")
+	}
+
+	resizeOp := query.Get("op")
+	if resizeOp == "" {
+		resizeOp = "crop"
+	}
+	var opts []string
+	switch resizeOp {
+	case "crop":
+		opts = append(opts, queryDefault(query, "g", "c"))
+	case "fit":
+		opts = append(opts, queryDefault(query, "bg", "0"))
+	case "fill", "scale", "inside", "outside":
+		opts = append(opts, "0")
+	default:
+		return nil, errors.New("invalid resizeOp")
+	}
+	if rect := query.Get("rect"); rect != "" {
+		opts = append(opts, "rect"+strings.Replace(rect, ",", ":", -1))
+	}
+	switch query.Get("enlarge") {
+	case "", "1":
+	case "0":
+		opts = append(opts, "noenlarge")
+	default:
+		return nil, errors.New("invalid enlarge")
+	}
+	if q := query.Get("q"); q != "" {
+		quality, err := strconv.Atoi(q)
+		if err != nil {
+			return nil, errors.New("invalid quality")
+		}
+		opts = append(opts, "q"+strconv.Itoa(quality))
+	}
+
+	vars := map[string]string{
+		"width":    width,
+		"height":   height,
+		"resizeOp": resizeOp,
+		"options":  strings.Join(opts, ","),
+	}
+	if format := query.Get("fmt"); format != "" {
+		vars["format"] = format
+	}
+	return vars, nil
+}
+
+// queryPinsFormat reports whether a query string API request pins the output
+// format, see varyMiddleware.
+func queryPinsFormat(r *http.Request) bool {
+	return r.URL.Query().Get("fmt") != ""
+}
+
+func queryDefault(query url.Values, param string, defaultValue string) string {
+	if value := query.Get(param); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// redirectToQuerySize redirects a query string API request to the same
+// thumbnail at width x height. Signed requests are rejected instead, as in
+// redirectToSize.
+func redirectToQuerySize(w http.ResponseWriter, r *http.Request, width int, height int) {
+	if len(config.C.SignatureKeys) > 0 {
+		respondWithErr(w, http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	query.Set("w", strconv.Itoa(width))
+	query.Set("h", strconv.Itoa(height))
+	http.Redirect(w, r, r.URL.EscapedPath()+"?"+query.Encode(), http.StatusFound)
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/collections"
+	"github.com/kxlt/imageresizer/store"
+)
+
+func TestQueryVars(t *testing.T) {
+	tests := []struct {
+		query string
+		vars  map[string]string
+	}{
+		{"w=300&h=200&op=crop&g=s&q=080&fmt=webp", map[string]string{
+			"width": "300", "height": "200", "resizeOp": "crop", "options": "s,q80", "format": "webp",
+		}},
+		{"w=300", map[string]string{
+			"width": "300", "height": "300", "resizeOp": "crop", "options": "c",
+		}},
+		{"h=200&op=fit&bg=ffffff", map[string]string{
+			"width": "200", "height": "200", "resizeOp": "fit", "options": "ffffff",
+		}},
+		{"w=300&h=200&op=fit", map[string]string{
+			"width": "300", "height": "200", "resizeOp": "fit", "options": "0",
+		}},
+		{"w=300&g=fp0.5:0.2&rect=10,20,300,400", map[string]string{
+			"width": "300", "height": "300", "resizeOp": "crop", "options": "fp0.5:0.2,rect10:20:300:400",
+		}},
+		{"w=50&op=scale&enlarge=1", map[string]string{
+			"width": "50", "height": "50", "resizeOp": "scale", "options": "0",
+		}},
+		{"w=300&h=200&op=inside&enlarge=0&q=80", map[string]string{
+			"width": "300", "height": "200", "resizeOp": "inside", "options": "0,noenlarge,q80",
+		}},
+		{"w=300&enlarge=no", nil},
+		{"w=0", nil},
+		{"w=-1", nil},
+		{"w=300&op=zoom", nil},
+		{"w=300&q=high", nil},
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.query)
+		vars, err := queryVars(query)
+		if test.vars == nil {
+			if err == nil {
+				t.Errorf("%s: expected error", test.query)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(vars, test.vars) {
+			t.Errorf("%s: expected %v, got %v (%v)", test.query, test.vars, vars, err)
+		}
+	}
+}
+
+func TestServeQueryThumbs(t *testing.T) {
+	api := newTestApi()
+	api.Originals = &store.TwoTier{Store: store.NewFileStore("../testdata")}
+	api.Thumbnails = &store.NoopCache{}
+	api.Tiers = collections.NewSyncStrSet()
+	api.Etags = collections.NewSyncStrSet()
+	api.Router = mux.NewRouter()
+	api.routes()
+
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"/samuel-clara-69657-unsplash.jpg?w=30&h=20&g=s&q=80", http.StatusOK},
+		{"/samuel-clara-69657-unsplash.jpg?w=30&g=x", http.StatusBadRequest},
+		{"/samuel-clara-69657-unsplash.jpg?w=30&fmt=tiff", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.url, test.status, w.Code)
+		}
+	}
+	// the same tier as /30x20/crop/s,q80/samuel-clara-69657-unsplash.jpg
+	if !api.Tiers.Contains("30x20/crop/s,q80") {
+		t.Errorf("query string thumbnail not cached under the canonical tier")
+	}
+}
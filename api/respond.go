@@ -2,26 +2,39 @@ package api
 
 import (
 	"encoding/json"
+	"github.com/kxlt/imageresizer/config"
 	"github.com/kxlt/imageresizer/imager"
 	"net/http"
 	"strconv"
 )
 
 type ImageResponse struct {
-	format imager.ImageType
-	buf    []byte
-	etag   string
+	format  imager.ImageType
+	buf     []byte
+	etag    string
+	vary    string
+	quality int
 }
 
 var mimeTypes = map[imager.ImageType]string{
 	imager.JPEG: "image/jpeg",
 	imager.PNG:  "image/png",
+	imager.WEBP: "image/webp",
+	imager.HEIF: "image/heif",
+	imager.AVIF: "image/avif",
+	imager.GIF:  "image/gif",
 }
 
 func respondWithImage(w http.ResponseWriter, imgResponse *ImageResponse) {
 	w.Header().Set("Content-Type", mimeTypes[imgResponse.format])
 	w.Header().Set("Content-Length", strconv.Itoa(len(imgResponse.buf)))
 	w.Header().Set("ETag", imgResponse.etag)
+	if imgResponse.vary != "" {
+		w.Header().Set("Vary", imgResponse.vary)
+	}
+	if imgResponse.quality > 0 {
+		w.Header().Set("X-Image-Quality", strconv.Itoa(imgResponse.quality))
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write(imgResponse.buf)
 }
@@ -33,6 +46,32 @@ func respondWithErr(w http.ResponseWriter, statusCode int) {
 	})
 }
 
+// respondWithImagerErr responds with the status code matching the type of an
+// imager error, and its cause in the body.
+func respondWithImagerErr(w http.ResponseWriter, err error) {
+	statusCode := http.StatusInternalServerError
+	if imagerErr, ok := err.(*imager.Error); ok {
+		switch imagerErr.Type {
+		case imager.UNSUPPORTED_FORMAT:
+			statusCode = http.StatusUnsupportedMediaType
+		case imager.INVALID_OPTIONS:
+			statusCode = http.StatusBadRequest
+		case imager.CORRUPT_INPUT, imager.LIMIT_EXCEEDED:
+			statusCode = http.StatusUnprocessableEntity
+		case imager.TIMEOUT:
+			statusCode = http.StatusGatewayTimeout
+		case imager.OVERLOADED:
+			statusCode = http.StatusServiceUnavailable
+			w.Header().Set("Retry-After", strconv.Itoa(config.C.ImagerRetryAfter))
+		}
+	}
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error": http.StatusText(statusCode),
+		"cause": err.Error(),
+	})
+}
+
 func respondWithStatusCode(w http.ResponseWriter, statusCode int) {
 	w.WriteHeader(statusCode)
 }
@@ -1,38 +1,90 @@
 package api
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/kxlt/imageresizer/config"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 	"unicode/utf8"
 
 	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/auth"
 	"github.com/kxlt/imageresizer/etag"
 	"github.com/kxlt/imageresizer/imager"
+	"github.com/kxlt/imageresizer/signature"
 	"github.com/rcrowley/go-metrics"
 )
 
 const pathMatch = "{path:.+}"
 
+// qualitySuffix is added to a thumbnail's cache key to store the quality it
+// was encoded with when it had a byte budget.
+const qualitySuffix = ".quality"
+
+// formatPathMatch matches a path with the output format appended to the
+// original's filename, e.g. photo.jpg.webp. The original must have an image
+// extension, so my.photo.jpg is the original my.photo.jpg, not my.photo as
+// JPEG.
+const formatPathMatch = "{path:.+\\.(?i:jpe?g|png|webp|avif|gif|heic|heif)}.{format:(?:jpg|png|webp|avif|gif)}"
+
 func (api *Api) routes() {
 	api.Handle("/favicon.ico", api.handle404())
 	api.Handle("/debug/metrics", http.DefaultServeMux)
-	// shortcut
-	api.HandleFunc("/{width:[1-9][0-9]*}/{resizeOp}/{options}/"+pathMatch,
-		api.etagMiddleware(api.serveThumbs())).Methods("GET", "HEAD")
-	api.HandleFunc("/{width:[1-9][0-9]*}x{height:[1-9][0-9]*}/{resizeOp}/{options}/"+pathMatch,
-		api.etagMiddleware(api.serveThumbs())).Methods("GET", "HEAD")
-	api.HandleFunc("/"+pathMatch, api.etagMiddleware(api.serveOriginals())).
-		Methods("GET", "HEAD")
-	api.HandleFunc("/"+pathMatch, api.handleCreates()).Methods("POST")
-	api.HandleFunc("/"+pathMatch, api.handleDeletes()).Methods("DELETE")
+	for _, tier := range []string{
+		"/{width:[1-9][0-9]*}/{resizeOp}/{options}/", // shortcut
+		"/{width:[1-9][0-9]*}x{height:[1-9][0-9]*}/{resizeOp}/{options}/",
+	} {
+		api.HandleFunc(tier+formatPathMatch, api.signatureMiddleware(
+			api.authMiddleware(auth.READ, api.etagMiddleware(api.serveThumbs())))).Methods("GET", "HEAD")
+		api.HandleFunc(tier+pathMatch, api.signatureMiddleware(api.authMiddleware(auth.READ,
+			api.varyMiddleware(nil, api.etagMiddleware(api.serveThumbs()))))).Methods("GET", "HEAD")
+	}
+	if len(api.presets) > 0 {
+		api.HandleFunc("/p/{preset}/"+pathMatch, api.signatureMiddleware(api.authMiddleware(auth.READ,
+			api.varyMiddleware(api.presetPinsFormat, api.etagMiddleware(api.servePresets()))))).
+			Methods("GET", "HEAD")
+	}
+	if config.C.ThumborEnable {
+		// signed Thumbor URLs are verified with thumbor.key, unsafe ones with
+		// the signature keys by serveThumbor
+		api.PathPrefix(config.C.ThumborPrefix+"/").MatcherFunc(isThumborURL).
+			HandlerFunc(api.serveThumbor()).Methods("GET", "HEAD")
+	}
+	if config.C.IIIFEnable {
+		iiif := config.C.IIIFPrefix + "/{identifier:.+}"
+		api.HandleFunc(iiif+"/info.json",
+			api.authVarMiddleware(auth.READ, "identifier", api.serveIIIFInfo())).Methods("GET", "HEAD")
+		// info.json doesn't serve the original's pixels, viewers fetch it
+		// before the signed image URLs
+		api.HandleFunc(iiif+"/{region}/{size}/{rotation}/{quality}.{format}",
+			api.signatureMiddleware(api.authVarMiddleware(auth.READ, "identifier",
+				api.etagMiddleware(api.serveIIIF())))).Methods("GET", "HEAD")
+		api.HandleFunc(iiif, redirectToIIIFInfo).Methods("GET", "HEAD")
+	}
+	api.HandleFunc("/"+pathMatch+metadataSuffix,
+		api.authMiddleware(auth.READ, api.serveMetadata())).Methods("GET", "HEAD")
+	api.HandleFunc("/"+pathMatch+metadataSuffix,
+		api.authMiddleware(auth.UPLOAD, api.handleMetadataPuts())).Methods("PUT")
+	api.HandleFunc("/"+pathMatch+metadataSuffix,
+		api.authMiddleware(auth.DELETE, api.handleMetadataDeletes())).Methods("DELETE")
+	api.HandleFunc("/"+pathMatch, api.signatureMiddleware(api.authMiddleware(auth.READ,
+		api.varyMiddleware(queryPinsFormat, api.etagMiddleware(api.serveQueryThumbs()))))).
+		Methods("GET", "HEAD").MatcherFunc(hasTransformQuery)
+	api.HandleFunc("/"+pathMatch,
+		api.authMiddleware(auth.READ, api.etagMiddleware(api.serveOriginals()))).Methods("GET", "HEAD")
+	api.HandleFunc("/"+pathMatch,
+		api.authMiddleware(auth.UPLOAD, api.handleCreates())).Methods("POST")
+	api.HandleFunc("/"+pathMatch,
+		api.authMiddleware(auth.DELETE, api.handleDeletes())).Methods("DELETE")
 }
 
 func (api *Api) etagMiddleware(h http.HandlerFunc) http.HandlerFunc {
@@ -48,6 +100,43 @@ func (api *Api) etagMiddleware(h http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// varyMiddleware sets the Vary header of thumbnails whose format is negotiated
+// through the Accept header, unless pinned reports that r pins it, before
+// etagMiddleware answers 304 Not Modified: it must vary like the thumbnail.
+func (api *Api) varyMiddleware(pinned func(*http.Request) bool, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if pinned == nil || !pinned(r) {
+			w.Header().Set("Vary", "Accept")
+		}
+		h(w, r)
+	}
+}
+
+// signatureMiddleware rejects requests without a valid signature, see package
+// signature, when signature keys are configured.
+func (api *Api) signatureMiddleware(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !validSignature(r) {
+			respondWithErr(w, http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// validSignature reports whether r is signed with one of the signature keys,
+// or no signature keys are configured.
+func validSignature(r *http.Request) bool {
+	if len(config.C.SignatureKeys) == 0 {
+		return true
+	}
+	keys := make([][]byte, len(config.C.SignatureKeys))
+	for i, key := range config.C.SignatureKeys {
+		keys[i] = []byte(key)
+	}
+	return signature.Verify(keys, r.URL.Path, r.URL.Query(), time.Now()) == nil
+}
+
 func (api *Api) serveOriginals() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		t := metrics.GetOrRegisterTimer("api.originals.latency", nil)
@@ -87,47 +176,170 @@ func (api *Api) serveThumbs() http.HandlerFunc {
 			if _, ok := vars["height"]; !ok {
 				vars["height"] = vars["width"]
 			}
-			resizeTier := fmt.Sprintf("%sx%s/%s/%s",
-				vars["width"],
-				vars["height"],
-				vars["resizeOp"],
-				vars["options"])
-			path := vars["path"]
-			thumbPath := resizeTier + "/" + path
-			api.Tiers.Add(resizeTier)
-			thumbBuf, _ := api.Thumbnails.Get(thumbPath)
-			if thumbBuf == nil {
-				srcBuf, err := api.Originals.Get(path)
-				if err != nil {
-					respondWithErr(w, http.StatusNotFound)
-					return
-				}
-				options, err := parseParams(vars)
-				if err != nil {
-					respondWithErr(w, http.StatusBadRequest)
-					return
-				}
-				thumbBuf, err = imager.Resize(srcBuf, options)
-				if err != nil {
-					respondWithErr(w, http.StatusInternalServerError)
-					return
-				}
-				go api.Thumbnails.Put(thumbPath, thumbBuf)
-			}
-			imgResponse := &ImageResponse{buf: thumbBuf}
+			api.serveTransform(w, r, vars, redirectToSize)
+		})
+	}
+}
 
-			etg := etag.Generate(thumbBuf, true)
-			if config.C.EtagCacheEnable {
-				api.Etags.Add(etg)
+// serveTransform responds with the thumbnail described by the route vars of
+// a thumbnail path, cached under the resizeTier of its canonical options.
+// Sizes that aren't allowed are redirected with redirect, if not nil, when
+// sizes.redirect is set; options that aren't allowed are rejected.
+func (api *Api) serveTransform(
+	w http.ResponseWriter,
+	r *http.Request,
+	vars map[string]string,
+	redirect func(http.ResponseWriter, *http.Request, int, int)) {
+
+	options, err := api.parseParams(vars)
+	if err != nil {
+		respondWithErr(w, http.StatusBadRequest)
+		return
+	}
+	width, height := options.Width, options.Height
+	if options.ResizeOp != imager.SCALE {
+		// scale percentages never exceed the original's size
+		width, height = allowedSize(width, height)
+	}
+	if width != options.Width || height != options.Height {
+		if config.C.SizesRedirect && redirect != nil {
+			redirect(w, r, width, height)
+		} else {
+			respondWithErr(w, http.StatusBadRequest)
+		}
+		return
+	}
+	meta := usesMetadata(vars["resizeOp"], vars["options"])
+	opts := canonicalOptions(options, meta)
+	for _, opt := range opts[1:] {
+		if !allowedOption(opt) {
+			respondWithErr(w, http.StatusBadRequest)
+			return
+		}
+	}
+	resizeTier := fmt.Sprintf("%dx%d/%s/%s",
+		width,
+		height,
+		vars["resizeOp"],
+		strings.Join(opts, ","))
+	api.serveThumb(w, r, resizeTier, vars["path"], options, meta)
+}
+
+// serveThumb responds with the thumbnail of the original at path, cached
+// under resizeTier, and creates it on cache misses. meta sets whether options
+// are completed with the metadata of the original.
+func (api *Api) serveThumb(
+	w http.ResponseWriter,
+	r *http.Request,
+	resizeTier string,
+	path string,
+	options imager.Options,
+	meta bool) {
+
+	imgResponse := &ImageResponse{}
+	if options.Format == imager.UNKNOWN {
+		options.Format = api.negotiateFormat(r.Header.Get("Accept"))
+		imgResponse.vary = "Accept"
+	}
+	thumbPath := resizeTier + "/" + path + formatSuffix(options.Format)
+	api.Tiers.Add(resizeTier)
+	thumbBuf, _ := api.Thumbnails.Get(thumbPath)
+	if thumbBuf != nil && options.MaxBytes > 0 {
+		// a budgeted thumbnail without its quality, evicted or not stored
+		// yet, is resized again so the quality can be reported
+		qualityBuf, _ := api.Thumbnails.Get(thumbPath + qualitySuffix)
+		quality, err := strconv.Atoi(string(qualityBuf))
+		if err != nil {
+			thumbBuf = nil
+		}
+		imgResponse.quality = quality
+	}
+	if thumbBuf == nil {
+		thumb, err := api.createThumb(r.Context(), path, thumbPath, options, meta)
+		if _, ok := err.(*imager.Error); ok {
+			respondWithImagerErr(w, err)
+			return
+		}
+		if os.IsNotExist(err) {
+			respondWithErr(w, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			// the store failed, the metadata is corrupt or the resize panicked
+			respondWithErr(w, http.StatusInternalServerError)
+			return
+		}
+		thumbBuf = thumb.buf
+		if options.MaxBytes > 0 {
+			imgResponse.quality = thumb.quality
+		}
+	}
+	imgResponse.buf = thumbBuf
+
+	etg := etag.Generate(thumbBuf, true)
+	if config.C.EtagCacheEnable {
+		api.Etags.Add(etg)
+	}
+	if r.Header.Get("If-None-Match") == etg {
+		respondWithStatusCode(w, http.StatusNotModified)
+		return
+	}
+	imgResponse.etag = etg
+	imgResponse.format = imager.GetImageType(thumbBuf)
+	respondWithImage(w, imgResponse)
+}
+
+type thumbnail struct {
+	buf     []byte
+	quality int
+}
+
+// createThumb resizes the original at path, with its metadata if meta is set,
+// and stores the result in the thumbnail cache. Concurrent misses for the same
+// thumbPath share one fetch and one resize.
+func (api *Api) createThumb(
+	ctx context.Context,
+	path string,
+	thumbPath string,
+	options imager.Options,
+	meta bool) (*thumbnail, error) {
+
+	for {
+		val, err, _ := api.resizes.Do(thumbPath, func() (interface{}, error) {
+			srcBuf, err := api.Originals.Get(path)
+			if err != nil {
+				return nil, err
 			}
-			if r.Header.Get("If-None-Match") == etg {
-				respondWithStatusCode(w, http.StatusNotModified)
-				return
+			options := options
+			if meta {
+				if options, err = api.withMetadata(path, srcBuf, options); err != nil {
+					return nil, err
+				}
 			}
-			imgResponse.etag = etg
-			imgResponse.format = imager.GetImageType(thumbBuf)
-			respondWithImage(w, imgResponse)
+			buf, quality, err := api.Imager.Resize(ctx, srcBuf, options)
+			if err != nil {
+				return nil, err
+			}
+			// the quality is stored first, so the thumbnail is never found
+			// without it unless it was evicted
+			go func(maxBytes int) {
+				if maxBytes > 0 {
+					api.Thumbnails.Put(thumbPath+qualitySuffix, []byte(strconv.Itoa(quality)))
+				}
+				api.Thumbnails.Put(thumbPath, buf)
+			}(options.MaxBytes)
+			return &thumbnail{buf: buf, quality: quality}, nil
 		})
+		// the shared call runs with the context of the request that started
+		// it, try again if that one was canceled but ours wasn't
+		imagerErr, ok := err.(*imager.Error)
+		if ok && imagerErr.Type == imager.CANCELED && ctx.Err() == nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return val.(*thumbnail), nil
 	}
 }
 
@@ -148,6 +360,11 @@ func (api *Api) handleCreates() http.HandlerFunc {
 			reader = r.Body
 		}
 		filename = mux.Vars(r)["path"]
+		if strings.HasSuffix(filename, metadataSuffix) {
+			// managed through PUT, see handleMetadataPuts
+			respondWithErr(w, http.StatusBadRequest)
+			return
+		}
 		buf, err := ioutil.ReadAll(io.LimitReader(reader, config.C.UploadMaxSize))
 		if len(buf) == 0 || err != nil {
 			respondWithErr(w, http.StatusBadRequest)
@@ -157,6 +374,12 @@ func (api *Api) handleCreates() http.HandlerFunc {
 			respondWithErr(w, http.StatusRequestEntityTooLarge)
 			return
 		}
+		if _, err := api.Imager.Probe(buf); err != nil {
+			if imagerErr, ok := err.(*imager.Error); ok && imagerErr.Type == imager.LIMIT_EXCEEDED {
+				respondWithImagerErr(w, err)
+				return
+			}
+		}
 		err = api.Originals.Put(filename, buf)
 		if err != nil {
 			respondWithErr(w, http.StatusInternalServerError)
@@ -175,7 +398,9 @@ func (api *Api) handleDeletes() http.HandlerFunc {
 			err := api.Originals.Remove(path)
 			if err != nil {
 				respondWithErr(w, http.StatusNotFound)
+				return
 			}
+			api.Originals.Remove(path + metadataSuffix)
 			api.removeThumbnails(path)
 			respondWithStatusCode(w, http.StatusNoContent)
 		})
@@ -188,7 +413,7 @@ func (api *Api) handle404() http.HandlerFunc {
 	}
 }
 
-func parseParams(vars map[string]string) (imager.Options, error) {
+func (api *Api) parseParams(vars map[string]string) (imager.Options, error) {
 	width, err := strconv.Atoi(vars["width"])
 	if err != nil {
 		return imager.Options{}, err
@@ -201,20 +426,45 @@ func parseParams(vars map[string]string) (imager.Options, error) {
 	if !ok {
 		return imager.Options{}, errors.New("invalid resizeOp")
 	}
+	if resizeOp == imager.SCALE && (width > 100 || height > 100) {
+		return imager.Options{}, errors.New("scale percentage above 100")
+	}
 	options := imager.Options{
-		Width:    width,
-		Height:   height,
-		ResizeOp: resizeOp,
+		Width:     width,
+		Height:    height,
+		ResizeOp:  resizeOp,
+		NoEnlarge: !config.C.SizesEnlarge,
+	}
+	if ext, ok := vars["format"]; ok {
+		format, ok := formats[ext]
+		if !ok || !api.canEncode(format) {
+			return imager.Options{}, errors.New("unsupported format")
+		}
+		options.Format = format
 	}
+	opts := strings.Split(vars["options"], ",")
 	switch resizeOp {
 	case imager.CROP:
-		gravity, ok := imager.Gravity[vars["options"]]
-		if !ok {
-			return imager.Options{}, errors.New("invalid gravity")
+		if opts[0] == focalGravity {
+			// completed with the metadata of the original, centered without
+			options.Gravity = imager.FOCAL
+			options.FocalX, options.FocalY = 0.5, 0.5
+		} else if strings.HasPrefix(opts[0], "fp") {
+			x, y, err := parseFocalPoint(opts[0][2:])
+			if err != nil {
+				return imager.Options{}, err
+			}
+			options.Gravity = imager.FOCAL
+			options.FocalX, options.FocalY = x, y
+		} else {
+			gravity, ok := imager.Gravity[opts[0]]
+			if !ok {
+				return imager.Options{}, errors.New("invalid gravity")
+			}
+			options.Gravity = gravity
 		}
-		options.Gravity = gravity
 	case imager.FIT:
-		extend := vars["options"]
+		extend := opts[0]
 		if utf8.RuneCountInString(extend) == 6 { // hex rgb
 			rgb, err := decodeHexRGB(extend)
 			if err != nil {
@@ -222,11 +472,125 @@ func parseParams(vars map[string]string) (imager.Options, error) {
 			}
 			options.ExtendBackground = rgb
 		}
+	default:
+		if opts[0] != "0" {
+			return imager.Options{}, errors.New("invalid option")
+		}
+	}
+	err = parseEncoderOptions(opts[1:], &options)
+	if err != nil {
+		return imager.Options{}, err
 	}
 
 	return options, nil
 }
 
+// parseEncoderOptions parses the encoder settings, source crop and noenlarge
+// following the gravity, extend or 0 option, e.g. the q75 and prog in
+// 300x300/crop/s,q75,prog
+func parseEncoderOptions(opts []string, options *imager.Options) error {
+	for _, opt := range opts {
+		switch {
+		case strings.HasPrefix(opt, "rect"):
+			region, err := parseRect(opt[4:])
+			if err != nil {
+				return err
+			}
+			options.Region = region
+		case opt == "noenlarge":
+			options.NoEnlarge = true
+		case opt == "prog":
+			options.Progressive = true
+		case opt == "pal":
+			options.Palette = true
+		case opt == "lossless":
+			options.Lossless = true
+		case opt == "nearlossless":
+			options.NearLossless = true
+		case opt == "p3":
+			if !config.C.ColorConvert {
+				return errors.New("p3 needs color.convert")
+			}
+			options.WideGamut = true
+		case strings.HasPrefix(opt, "q"):
+			quality, err := strconv.Atoi(opt[1:])
+			if err != nil || quality < 1 || quality > 100 {
+				return errors.New("invalid quality")
+			}
+			options.Quality = quality
+		case strings.HasPrefix(opt, "b"):
+			maxBytes, err := parseByteBudget(opt[1:])
+			if err != nil {
+				return err
+			}
+			options.MaxBytes = maxBytes
+		case strings.HasPrefix(opt, "z"):
+			compression, err := strconv.Atoi(opt[1:])
+			if err != nil || compression < 1 || compression > 9 {
+				return errors.New("invalid compression level")
+			}
+			options.Compression = compression
+		default:
+			return errors.New("invalid encoder option")
+		}
+	}
+	return nil
+}
+
+// parseFocalPoint parses a focal point relative to the width and height of
+// the source, e.g. the 0.3:0.7 in 300x300/crop/fp0.3:0.7, rounded to 0.01
+func parseFocalPoint(point string) (float64, float64, error) {
+	coords := strings.Split(point, ":")
+	if len(coords) != 2 {
+		return 0, 0, errors.New("invalid focal point")
+	}
+	x, err := strconv.ParseFloat(coords[0], 64)
+	if err != nil || x < 0 || x > 1 {
+		return 0, 0, errors.New("invalid focal point")
+	}
+	y, err := strconv.ParseFloat(coords[1], 64)
+	if err != nil || y < 0 || y > 1 {
+		return 0, 0, errors.New("invalid focal point")
+	}
+	// finer focal points would only add cached variants
+	return math.Round(x*100) / 100, math.Round(y*100) / 100, nil
+}
+
+// parseRect parses a source crop in pixels of the original, x:y:width:height,
+// e.g. the 100:50:800:600 in 300x300/crop/c,rect100:50:800:600
+func parseRect(rect string) (imager.Region, error) {
+	var values [4]int
+	parts := strings.Split(rect, ":")
+	if len(parts) != len(values) {
+		return imager.Region{}, errors.New("invalid source crop")
+	}
+	for i, part := range parts {
+		value, err := strconv.Atoi(part)
+		if err != nil || value < 0 || i >= 2 && value < 1 {
+			return imager.Region{}, errors.New("invalid source crop")
+		}
+		values[i] = value
+	}
+	return imager.Region{X: values[0], Y: values[1], Width: values[2], Height: values[3]}, nil
+}
+
+// maxByteBudget is the largest byte budget accepted, far above any thumbnail
+const maxByteBudget = 64 << 20
+
+// parseByteBudget parses a byte budget in bytes or, with a k suffix, in KiB
+func parseByteBudget(budget string) (int, error) {
+	factor := 1
+	if strings.HasSuffix(budget, "k") {
+		budget = strings.TrimSuffix(budget, "k")
+		factor = 1024
+	}
+	maxBytes, err := strconv.Atoi(budget)
+	if err != nil || maxBytes < 1 || maxBytes > maxByteBudget/factor {
+		return 0, errors.New("invalid byte budget")
+	}
+	return maxBytes * factor, nil
+}
+
 func decodeHexRGB(hexRGB string) ([]float64, error) {
 	runes := []rune(hexRGB)
 	var (
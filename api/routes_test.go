@@ -0,0 +1,437 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/collections"
+	"github.com/kxlt/imageresizer/config"
+	"github.com/kxlt/imageresizer/imager"
+	"github.com/kxlt/imageresizer/signature"
+	"github.com/kxlt/imageresizer/store"
+)
+
+func TestParseParams_EncoderOptions(t *testing.T) {
+	api := newTestApi()
+	vars := map[string]string{
+		"width":    "300",
+		"height":   "200",
+		"resizeOp": "fit",
+		"options":  "ffffff,q75,z9,prog,pal",
+	}
+	options, err := api.parseParams(vars)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := imager.Options{
+		Width:            300,
+		Height:           200,
+		ResizeOp:         imager.FIT,
+		ExtendBackground: []float64{255, 255, 255},
+		Quality:          75,
+		Compression:      9,
+		Progressive:      true,
+		Palette:          true,
+	}
+	if options.Quality != expected.Quality ||
+		options.Compression != expected.Compression ||
+		options.Progressive != expected.Progressive ||
+		options.Palette != expected.Palette ||
+		len(options.ExtendBackground) != 3 {
+		t.Errorf("expected %+v, got %+v", expected, options)
+	}
+
+	for _, invalid := range []string{"s,q0", "s,q101", "s,qx", "s,z0", "s,z10", "s,b0", "s,bk", "s,foo"} {
+		vars := map[string]string{
+			"width":    "300",
+			"height":   "200",
+			"resizeOp": "crop",
+			"options":  invalid,
+		}
+		if _, err := api.parseParams(vars); err == nil {
+			t.Errorf("%s: expected error", invalid)
+		}
+	}
+}
+
+func TestParseParams_WideGamut(t *testing.T) {
+	defer func(convert bool) { config.C.ColorConvert = convert }(config.C.ColorConvert)
+	api := newTestApi()
+	vars := map[string]string{"width": "300", "height": "200", "resizeOp": "crop", "options": "c,p3"}
+	config.C.ColorConvert = true
+	if options, err := api.parseParams(vars); err != nil || !options.WideGamut {
+		t.Errorf("expected WideGamut, got %+v (%v)", options, err)
+	}
+	config.C.ColorConvert = false
+	if _, err := api.parseParams(vars); err == nil {
+		t.Errorf("expected error without color.convert")
+	}
+}
+
+func TestParseParams_Gravity(t *testing.T) {
+	api := newTestApi()
+	tests := []struct {
+		options  string
+		expected imager.Options
+	}{
+		{"ne", imager.Options{Gravity: imager.NORTH_EAST}},
+		{"south", imager.Options{Gravity: imager.SOUTH}},
+		{"fp0.25:1", imager.Options{Gravity: imager.FOCAL, FocalX: 0.25, FocalY: 1}},
+		{"focal", imager.Options{Gravity: imager.FOCAL, FocalX: 0.5, FocalY: 0.5}},
+		{"c,rect10:20:300:400", imager.Options{Gravity: imager.CENTER,
+			Region: imager.Region{X: 10, Y: 20, Width: 300, Height: 400}}},
+		{"fp0.5:0.5,rect0:0:1:1,q80", imager.Options{Gravity: imager.FOCAL, FocalX: 0.5, FocalY: 0.5,
+			Region: imager.Region{Width: 1, Height: 1}, Quality: 80}},
+	}
+	for _, test := range tests {
+		vars := map[string]string{
+			"width":    "300",
+			"height":   "200",
+			"resizeOp": "crop",
+			"options":  test.options,
+		}
+		options, err := api.parseParams(vars)
+		test.expected.Width, test.expected.Height = 300, 200
+		if err != nil || !reflect.DeepEqual(options, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v (%v)", test.options, test.expected, options, err)
+		}
+	}
+
+	for _, invalid := range []string{"sw2", "fp", "fp0.5", "fp1.5:0", "fp-1:0", "fpx:y",
+		"c,rect", "c,rect1:2:3", "c,rect0:0:0:10", "c,rect-1:0:10:10", "c,rect0:0:a:10"} {
+		vars := map[string]string{
+			"width":    "300",
+			"height":   "200",
+			"resizeOp": "crop",
+			"options":  invalid,
+		}
+		if _, err := api.parseParams(vars); err == nil {
+			t.Errorf("%s: expected error", invalid)
+		}
+	}
+}
+
+func TestParseParams_ResizeOps(t *testing.T) {
+	defer func(enlarge bool) { config.C.SizesEnlarge = enlarge }(config.C.SizesEnlarge)
+	config.C.SizesEnlarge = true
+
+	api := newTestApi()
+	tests := []struct {
+		size     [2]string
+		resizeOp string
+		options  string
+		enlarge  bool
+		expected imager.Options
+	}{
+		{[2]string{"300", "200"}, "fill", "0", true, imager.Options{Width: 300, Height: 200, ResizeOp: imager.FILL}},
+		{[2]string{"50", "25"}, "scale", "0,q80", true, imager.Options{Width: 50, Height: 25, ResizeOp: imager.SCALE, Quality: 80}},
+		{[2]string{"300", "200"}, "inside", "0,noenlarge", true,
+			imager.Options{Width: 300, Height: 200, ResizeOp: imager.INSIDE, NoEnlarge: true}},
+		{[2]string{"300", "200"}, "outside", "0", false,
+			imager.Options{Width: 300, Height: 200, ResizeOp: imager.OUTSIDE, NoEnlarge: true}},
+		{[2]string{"300", "200"}, "crop", "c", false,
+			imager.Options{Width: 300, Height: 200, ResizeOp: imager.CROP, Gravity: imager.CENTER, NoEnlarge: true}},
+	}
+	for _, test := range tests {
+		config.C.SizesEnlarge = test.enlarge
+		vars := map[string]string{
+			"width":    test.size[0],
+			"height":   test.size[1],
+			"resizeOp": test.resizeOp,
+			"options":  test.options,
+		}
+		options, err := api.parseParams(vars)
+		if err != nil || !reflect.DeepEqual(options, test.expected) {
+			t.Errorf("%s/%s: expected %+v, got %+v (%v)", test.resizeOp, test.options, test.expected, options, err)
+		}
+	}
+
+	config.C.SizesEnlarge = true
+	for _, invalid := range [][2]string{{"fill", "c"}, {"inside", "ffffff"}, {"outside", "0,enlarge"}, {"zoom", "0"}} {
+		vars := map[string]string{
+			"width":    "300",
+			"height":   "200",
+			"resizeOp": invalid[0],
+			"options":  invalid[1],
+		}
+		if _, err := api.parseParams(vars); err == nil {
+			t.Errorf("%s/%s: expected error", invalid[0], invalid[1])
+		}
+	}
+	vars := map[string]string{"width": "150", "height": "50", "resizeOp": "scale", "options": "0"}
+	if _, err := api.parseParams(vars); err == nil {
+		t.Errorf("scale above 100%%: expected error")
+	}
+}
+
+func TestParseByteBudget(t *testing.T) {
+	tests := []struct {
+		budget   string
+		maxBytes int
+	}{
+		{"30000", 30000},
+		{"30k", 30 * 1024},
+	}
+	for _, test := range tests {
+		maxBytes, err := parseByteBudget(test.budget)
+		if err != nil || maxBytes != test.maxBytes {
+			t.Errorf("%s: expected %d, got %d (%v)", test.budget, test.maxBytes, maxBytes, err)
+		}
+	}
+	for _, budget := range []string{"0", "-1k", "k", "67108865", "65537k", "9223372036854775807k"} {
+		if _, err := parseByteBudget(budget); err == nil {
+			t.Errorf("%s: expected error", budget)
+		}
+	}
+}
+
+func TestServeThumbs_BudgetWithoutQuality(t *testing.T) {
+	api := newTestApi()
+	api.Originals = &store.TwoTier{Store: store.NewFileStore("../testdata")}
+	// not goroutine-safe, but only the resize writes to it once it's served
+	api.Thumbnails = mapCache{"30x30/crop/c,b30k/metadata.jpg.jpg": []byte("thumbnail")}
+	api.Tiers = collections.NewSyncStrSet()
+	api.Etags = collections.NewSyncStrSet()
+	api.Router = mux.NewRouter()
+	api.routes()
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest("GET", "/30x30/crop/c,b30k/metadata.jpg.jpg", nil))
+	if w.Code != http.StatusOK || w.Body.String() == "thumbnail" || w.Header().Get("X-Image-Quality") == "" {
+		t.Errorf("expected a new thumbnail with its quality, got %d with quality %q",
+			w.Code, w.Header().Get("X-Image-Quality"))
+	}
+}
+
+func TestRoutes_FormatPath(t *testing.T) {
+	api := newTestApi()
+	api.Router = mux.NewRouter()
+	api.routes()
+	tests := []struct {
+		url    string
+		path   string
+		format string
+	}{
+		{"/300x300/crop/c/photo.jpg.webp", "photo.jpg", "webp"},
+		{"/300x300/crop/c/dir/IMG_1.JPG.png", "dir/IMG_1.JPG", "png"},
+		{"/300x300/crop/c/my.photo.jpg", "my.photo.jpg", ""},
+		{"/300x300/crop/c/IMG_1.edit.png", "IMG_1.edit.png", ""},
+		{"/300/crop/c/photo.v2.jpg", "photo.v2.jpg", ""},
+		{"/300/crop/c/photo.v2.jpg.avif", "photo.v2.jpg", "avif"},
+		{"/300x300/crop/c/photo.jpg", "photo.jpg", ""},
+	}
+	for _, test := range tests {
+		var match mux.RouteMatch
+		if !api.Router.Match(httptest.NewRequest("GET", test.url, nil), &match) {
+			t.Errorf("%s: no route", test.url)
+			continue
+		}
+		if match.Vars["path"] != test.path || match.Vars["format"] != test.format {
+			t.Errorf("%s: expected path %q and format %q, got %q and %q",
+				test.url, test.path, test.format, match.Vars["path"], match.Vars["format"])
+		}
+	}
+}
+
+// countingStore counts the originals fetched from its Store.
+type countingStore struct {
+	store.Store
+	gets int32
+}
+
+func (s *countingStore) Get(filename string) ([]byte, error) {
+	atomic.AddInt32(&s.gets, 1)
+	return s.Store.Get(filename)
+}
+
+// countingImager counts resizes, which are slowed down so concurrent requests
+// pile up behind the first one.
+type countingImager struct {
+	imager.Imager
+	resizes int32
+}
+
+func (i *countingImager) Resize(ctx context.Context, buf []byte, options imager.Options) ([]byte, int, error) {
+	atomic.AddInt32(&i.resizes, 1)
+	time.Sleep(100 * time.Millisecond)
+	return i.Imager.Resize(ctx, buf, options)
+}
+
+func TestServeThumbs_Coalesced(t *testing.T) {
+	originals := &countingStore{Store: store.NewFileStore("../testdata")}
+	img := &countingImager{Imager: newTestApi().Imager}
+	api := &Api{
+		Originals:  &store.TwoTier{Store: originals},
+		Thumbnails: &store.NoopCache{},
+		Tiers:      collections.NewSyncStrSet(),
+		Etags:      collections.NewSyncStrSet(),
+		Imager:     img,
+		Router:     mux.NewRouter(),
+	}
+	api.routes()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, httptest.NewRequest("GET", "/30x20/crop/c/samuel-clara-69657-unsplash.jpg", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("expected status 200, got %d", w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+	if originals.gets != 1 || img.resizes != 1 {
+		t.Errorf("expected 1 fetch and 1 resize, got %d and %d", originals.gets, img.resizes)
+	}
+}
+
+func TestSignatureMiddleware(t *testing.T) {
+	defer func(keys []string) { config.C.SignatureKeys = keys }(config.C.SignatureKeys)
+	api := newTestApi()
+	h := api.signatureMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	path := "/300x300/crop/s/photo.jpg"
+	tests := []struct {
+		keys   []string
+		url    string
+		status int
+	}{
+		{nil, path, http.StatusOK},
+		{[]string{"new", "old"}, path, http.StatusForbidden},
+		{[]string{"new", "old"}, signature.SignURL([]byte("old"), path, nil, time.Time{}), http.StatusOK},
+		{[]string{"new"}, signature.SignURL([]byte("old"), path, nil, time.Time{}), http.StatusForbidden},
+		{[]string{"new"}, signature.SignURL([]byte("new"), path, nil, time.Now().Add(-time.Minute)), http.StatusForbidden},
+	}
+	for _, test := range tests {
+		config.C.SignatureKeys = test.keys
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("%v %s: expected status %d, got %d", test.keys, test.url, test.status, w.Code)
+		}
+	}
+}
+
+func TestRoutes_Signature(t *testing.T) {
+	defer func(c config.Config) { config.C = c }(config.C)
+	config.C.SignatureKeys = []string{"key"}
+	config.C.Presets = map[string]string{"avatar": "30x30/crop/c/jpg"}
+	config.C.ThumborEnable = true
+	config.C.ThumborPrefix = "/thumbor"
+	config.C.ThumborKey = "MY_SECURE_KEY"
+	config.C.ThumborUnsafe = true
+	config.C.IIIFEnable = true
+	config.C.IIIFPrefix = "/iiif"
+
+	api := newTestApi()
+	api.Originals = &store.TwoTier{Store: store.NewFileStore("../testdata")}
+	api.Thumbnails = &store.NoopCache{}
+	api.Tiers = collections.NewSyncStrSet()
+	api.Etags = collections.NewSyncStrSet()
+	api.Router = mux.NewRouter()
+	api.initPresets()
+	api.routes()
+
+	sign := func(url string) string {
+		return signature.SignURL([]byte("key"), url, nil, time.Time{})
+	}
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"/30x30/crop/c/samuel-clara-69657-unsplash.jpg", http.StatusForbidden},
+		{sign("/30x30/crop/c/samuel-clara-69657-unsplash.jpg"), http.StatusOK},
+		{"/p/avatar/samuel-clara-69657-unsplash.jpg", http.StatusForbidden},
+		{sign("/p/avatar/samuel-clara-69657-unsplash.jpg"), http.StatusOK},
+		{"/thumbor/unsafe/30x20/samuel-clara-69657-unsplash.jpg", http.StatusForbidden},
+		{sign("/thumbor/unsafe/30x20/samuel-clara-69657-unsplash.jpg"), http.StatusOK},
+		// signed with thumbor.key instead
+		{"/thumbor/rm-5GyMOmr9sw-CGVzNlQw8lsJI=/30x20/smart/samuel-clara-69657-unsplash.jpg", http.StatusOK},
+		{"/iiif/samuel-clara-69657-unsplash.jpg/full/30,/0/default.jpg", http.StatusForbidden},
+		{sign("/iiif/samuel-clara-69657-unsplash.jpg/full/30,/0/default.jpg"), http.StatusOK},
+		{"/iiif/samuel-clara-69657-unsplash.jpg/info.json", http.StatusOK},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.url, test.status, w.Code)
+		}
+	}
+}
+
+func TestServeThumbs_RectOutside(t *testing.T) {
+	api := newTestApi()
+	api.Originals = &store.TwoTier{Store: store.NewFileStore("../testdata")}
+	api.Thumbnails = &store.NoopCache{}
+	api.Tiers = collections.NewSyncStrSet()
+	api.Etags = collections.NewSyncStrSet()
+	api.Router = mux.NewRouter()
+	api.routes()
+
+	// metadata.jpg is 32x32
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"/10x10/crop/c,rect16:16:32:32/metadata.jpg", http.StatusOK},
+		{"/10x10/crop/c,rect32:0:10:10/metadata.jpg", http.StatusBadRequest},
+		{"/metadata.jpg?w=10&rect=0,40,10,10", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.url, test.status, w.Code)
+		}
+	}
+}
+
+func TestRoutes_VaryNotModified(t *testing.T) {
+	defer func(c config.Config) { config.C = c }(config.C)
+	config.C.EtagCacheEnable = true
+	config.C.Presets = map[string]string{"avatar": "30x30/crop/c", "avatar-png": "30x30/crop/c/png"}
+
+	api := newTestApi()
+	api.Originals = &store.TwoTier{Store: store.NewFileStore("../testdata")}
+	api.Thumbnails = &store.NoopCache{}
+	api.Tiers = collections.NewSyncStrSet()
+	api.Etags = collections.NewSyncStrSet()
+	api.Router = mux.NewRouter()
+	api.initPresets()
+	api.routes()
+	api.Etags.Add(`"known"`)
+
+	tests := []struct {
+		url  string
+		vary string
+	}{
+		{"/30x30/crop/c/metadata.jpg", "Accept"},
+		{"/30x30/crop/c/metadata.jpg.png", ""},
+		{"/p/avatar/metadata.jpg", "Accept"},
+		{"/p/avatar-png/metadata.jpg", ""},
+		{"/metadata.jpg?w=30&h=30", "Accept"},
+		{"/metadata.jpg?w=30&h=30&fmt=png", ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", test.url, nil)
+		r.Header.Set("If-None-Match", `"known"`)
+		api.ServeHTTP(w, r)
+		if w.Code != http.StatusNotModified || w.Header().Get("Vary") != test.vary {
+			t.Errorf("%s: expected 304 with Vary %q, got %d with %q",
+				test.url, test.vary, w.Code, w.Header().Get("Vary"))
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/kxlt/imageresizer/config"
+	"github.com/kxlt/imageresizer/imager"
+)
+
+// allowedSize returns the allowed size nearest to width x height. Sizes not
+// in the sizes.allowed list, when set, or otherwise not a multiple of
+// sizes.step or above sizes.max are not allowed.
+func allowedSize(width int, height int) (int, int) {
+	if len(config.C.SizesAllowed) > 0 {
+		return nearestSize(width, height, config.C.SizesAllowed)
+	}
+	return allowedDimension(width), allowedDimension(height)
+}
+
+// nearestSize returns the size in sizes with the smallest difference in
+// width and height to width x height, preferring the larger one on ties.
+func nearestSize(width int, height int, sizes []config.Size) (int, int) {
+	nearest := sizes[0]
+	minDistance := -1
+	for _, size := range sizes {
+		distance := abs(size.Width-width) + abs(size.Height-height)
+		if minDistance < 0 || distance < minDistance ||
+			distance == minDistance && size.Width*size.Height > nearest.Width*nearest.Height {
+			nearest = size
+			minDistance = distance
+		}
+	}
+	return nearest.Width, nearest.Height
+}
+
+func allowedDimension(n int) int {
+	step, max := config.C.SizesStep, config.C.SizesMax
+	if step > 0 {
+		n = (n + step/2) / step * step
+		if n < step {
+			n = step
+		}
+	}
+	if max > 0 && n > max {
+		n = max
+		if step > 0 {
+			n -= max % step
+		}
+	}
+	return n
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// redirectToSize redirects a thumbnail request to the same thumbnail at
+// width x height. Signed requests are rejected instead, the signature doesn't
+// cover the new size.
+func redirectToSize(w http.ResponseWriter, r *http.Request, width int, height int) {
+	if len(config.C.SignatureKeys) > 0 {
+		respondWithErr(w, http.StatusBadRequest)
+		return
+	}
+	// the size is the first segment of thumbnail URLs
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/", 2)
+	url := fmt.Sprintf("/%dx%d/%s", width, height, parts[len(parts)-1])
+	if r.URL.RawQuery != "" {
+		url += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// canonicalOptions returns the options segment of the thumbnail path parsed
+// into options in its canonical form, so that equivalent paths, e.g.
+// c,prog,q75 and c,q75,prog,q75, share their resizeTier and thumbnails. The
+// encoder options follow the gravity or extend in a fixed order, without
+// duplicates; meta is the focal gravity.
+func canonicalOptions(options imager.Options, meta bool) []string {
+	var opts []string
+	switch {
+	case meta:
+		opts = append(opts, focalGravity)
+	case options.ResizeOp == imager.CROP && options.Gravity == imager.FOCAL:
+		opts = append(opts, "fp"+formatFocal(options.FocalX)+":"+formatFocal(options.FocalY))
+	case options.ResizeOp == imager.CROP:
+		for name, gravity := range imager.Gravity {
+			if gravity == options.Gravity {
+				opts = append(opts, name)
+			}
+		}
+	case options.ResizeOp == imager.FIT && options.ExtendBackground != nil:
+		rgb := options.ExtendBackground
+		opts = append(opts, fmt.Sprintf("%02x%02x%02x", int(rgb[0]), int(rgb[1]), int(rgb[2])))
+	default:
+		opts = append(opts, "0")
+	}
+	region := options.Region
+	if region.Width > 0 && region.Height > 0 {
+		opts = append(opts, fmt.Sprintf("rect%d:%d:%d:%d", region.X, region.Y, region.Width, region.Height))
+	}
+	if options.NoEnlarge && config.C.SizesEnlarge {
+		opts = append(opts, "noenlarge")
+	}
+	for _, flag := range []struct {
+		set  bool
+		name string
+	}{
+		{options.Progressive, "prog"},
+		{options.Palette, "pal"},
+		{options.Lossless, "lossless"},
+		{options.NearLossless, "nearlossless"},
+		{options.WideGamut, "p3"},
+	} {
+		if flag.set {
+			opts = append(opts, flag.name)
+		}
+	}
+	if options.Quality > 0 {
+		opts = append(opts, "q"+strconv.Itoa(options.Quality))
+	}
+	if options.MaxBytes%1024 == 0 && options.MaxBytes > 0 {
+		opts = append(opts, "b"+strconv.Itoa(options.MaxBytes/1024)+"k")
+	} else if options.MaxBytes > 0 {
+		opts = append(opts, "b"+strconv.Itoa(options.MaxBytes))
+	}
+	if options.Compression > 0 {
+		opts = append(opts, "z"+strconv.Itoa(options.Compression))
+	}
+	return opts
+}
+
+// formatFocal formats a focal point coordinate, rounded to 0.01 by
+// parseFocalPoint, without trailing zeros.
+func formatFocal(coord float64) string {
+	return strconv.FormatFloat(coord, 'f', -1, 64)
+}
+
+// valuedOptions are the options of sizes.options that allow any value when
+// listed without one, e.g. q allows any quality.
+var valuedOptions = []string{"rect", "q", "b", "z"}
+
+// allowedOption reports whether the canonical encoder option or source crop
+// opt is allowed by sizes.options, e.g. q75 by q75 or q. An empty list allows
+// any option, noenlarge is always allowed.
+func allowedOption(opt string) bool {
+	if len(config.C.SizesOptions) == 0 || opt == "noenlarge" {
+		return true
+	}
+	for _, allowed := range config.C.SizesOptions {
+		if opt == allowed {
+			return true
+		}
+		for _, name := range valuedOptions {
+			if allowed == name && strings.HasPrefix(opt, name) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,208 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/collections"
+	"github.com/kxlt/imageresizer/config"
+	"github.com/kxlt/imageresizer/signature"
+	"github.com/kxlt/imageresizer/store"
+)
+
+var testSizes = []config.Size{
+	{Width: 300, Height: 300},
+	{Width: 480, Height: 640},
+}
+
+func TestAllowedSize(t *testing.T) {
+	defer func(c config.Config) { config.C = c }(config.C)
+	tests := []struct {
+		allowed        []config.Size
+		step           int
+		max            int
+		width          int
+		height         int
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{nil, 0, 0, 1, 1, 1, 1},
+		{nil, 100, 0, 1, 1, 100, 100},
+		{nil, 100, 0, 349, 351, 300, 400},
+		{nil, 0, 1000, 1200, 800, 1000, 800},
+		{nil, 100, 1050, 1200, 1020, 1000, 1000},
+		{testSizes, 100, 0, 480, 640, 480, 640},
+		{testSizes, 0, 0, 1, 1, 300, 300},
+		{testSizes, 0, 0, 400, 500, 480, 640},
+	}
+	for _, test := range tests {
+		config.C.SizesAllowed = test.allowed
+		config.C.SizesStep = test.step
+		config.C.SizesMax = test.max
+		width, height := allowedSize(test.width, test.height)
+		if width != test.expectedWidth || height != test.expectedHeight {
+			t.Errorf("%+v: expected %dx%d, got %dx%d",
+				test, test.expectedWidth, test.expectedHeight, width, height)
+		}
+	}
+}
+
+func TestServeThumbs_Sizes(t *testing.T) {
+	defer func(c config.Config) { config.C = c }(config.C)
+	config.C.SizesAllowed = testSizes
+
+	api := newTestApi()
+	api.Router = mux.NewRouter()
+	api.routes()
+
+	tests := []struct {
+		redirect bool
+		url      string
+		status   int
+		location string
+	}{
+		{false, "/1x1/crop/c/photo.jpg", http.StatusBadRequest, ""},
+		{true, "/1x1/crop/c/photo.jpg", http.StatusFound, "/300x300/crop/c/photo.jpg"},
+		{true, "/500/fit/0/dir/photo.jpg.webp?v=2", http.StatusFound, "/480x640/fit/0/dir/photo.jpg.webp?v=2"},
+		{true, "/dir/photo.jpg?w=1&op=fit", http.StatusFound, "/dir/photo.jpg?h=300&op=fit&w=300"},
+		// scale percentages aren't sizes
+		{true, "/150/scale/0/photo.jpg", http.StatusBadRequest, ""},
+	}
+	for _, test := range tests {
+		config.C.SizesRedirect = test.redirect
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.status || w.Header().Get("Location") != test.location {
+			t.Errorf("%s: expected %d %q, got %d %q",
+				test.url, test.status, test.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	// the signature wouldn't match the redirected URL
+	config.C.SizesRedirect = true
+	config.C.SignatureKeys = []string{"key"}
+	for _, signed := range []string{
+		signature.SignURL([]byte("key"), "/1x1/crop/c/photo.jpg", nil, time.Time{}),
+		signature.SignURL([]byte("key"), "/dir/photo.jpg", url.Values{"w": {"1"}}, time.Time{}),
+	} {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", signed, nil))
+		if w.Code != http.StatusBadRequest || w.Header().Get("Location") != "" {
+			t.Errorf("%s: expected 400, got %d %q", signed, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
+
+func TestCanonicalOptions(t *testing.T) {
+	defer func(c config.Config) { config.C = c }(config.C)
+	config.C.SizesEnlarge = true
+	api := newTestApi()
+	tests := []struct {
+		resizeOp string
+		options  string
+		expected string
+	}{
+		{"crop", "c", "c"},
+		{"crop", "south,q75,prog", "south,prog,q75"},
+		{"crop", "c,q80,q75,prog,prog", "c,prog,q75"},
+		{"crop", "fp0.30:0.7", "fp0.3:0.7"},
+		{"crop", "fp0.333:0.5", "fp0.33:0.5"},
+		{"crop", "focal,b102400", "focal,b100k"},
+		{"crop", "c,b1000", "c,b1000"},
+		{"crop", "c,z6,noenlarge,rect1:2:3:4", "c,rect1:2:3:4,noenlarge,z6"},
+		{"fit", "FFDEA5", "ffdea5"},
+		{"fit", "abc", "0"},
+		{"inside", "0,pal,lossless", "0,pal,lossless"},
+	}
+	for _, test := range tests {
+		vars := map[string]string{"width": "300", "height": "200", "resizeOp": test.resizeOp, "options": test.options}
+		options, err := api.parseParams(vars)
+		if err != nil {
+			t.Errorf("%s: %v", test.options, err)
+			continue
+		}
+		meta := usesMetadata(test.resizeOp, test.options)
+		if opts := strings.Join(canonicalOptions(options, meta), ","); opts != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.options, test.expected, opts)
+		}
+	}
+
+	// noenlarge is implied by sizes.enlarge=false
+	config.C.SizesEnlarge = false
+	vars := map[string]string{"width": "300", "height": "200", "resizeOp": "crop", "options": "c,noenlarge"}
+	options, _ := api.parseParams(vars)
+	if opts := strings.Join(canonicalOptions(options, false), ","); opts != "c" {
+		t.Errorf("expected c, got %s", opts)
+	}
+}
+
+func TestAllowedOption(t *testing.T) {
+	defer func(c config.Config) { config.C = c }(config.C)
+	tests := []struct {
+		allowed  []string
+		opt      string
+		expected bool
+	}{
+		{nil, "q33", true},
+		{nil, "rect1:2:3:4", true},
+		{[]string{"q75", "prog"}, "q75", true},
+		{[]string{"q75", "prog"}, "q76", false},
+		{[]string{"q75", "prog"}, "prog", true},
+		{[]string{"q75", "prog"}, "pal", false},
+		{[]string{"q75", "prog"}, "noenlarge", true},
+		{[]string{"q"}, "q33", true},
+		{[]string{"b100k"}, "b100k", true},
+		{[]string{"b100k"}, "b99k", false},
+		{[]string{"prog"}, "rect1:2:3:4", false},
+		{[]string{"rect"}, "rect1:2:3:4", true},
+		{[]string{"p3"}, "pal", false},
+	}
+	for _, test := range tests {
+		config.C.SizesOptions = test.allowed
+		if allowed := allowedOption(test.opt); allowed != test.expected {
+			t.Errorf("%v %s: expected %t, got %t", test.allowed, test.opt, test.expected, allowed)
+		}
+	}
+}
+
+func TestServeThumbs_Options(t *testing.T) {
+	defer func(c config.Config) { config.C = c }(config.C)
+	config.C.SizesOptions = []string{"q75", "b"}
+
+	api := newTestApi()
+	api.Originals = &store.TwoTier{Store: store.NewFileStore("../testdata")}
+	api.Thumbnails = &store.NoopCache{}
+	api.Tiers = collections.NewSyncStrSet()
+	api.Etags = collections.NewSyncStrSet()
+	api.Router = mux.NewRouter()
+	api.routes()
+
+	tests := []struct {
+		url    string
+		status int
+	}{
+		{"/300x300/crop/c/metadata.jpg", http.StatusOK},
+		{"/300x300/crop/c,q75/metadata.jpg", http.StatusOK},
+		{"/300x300/crop/c,q76/metadata.jpg", http.StatusBadRequest},
+		{"/300x300/crop/c,rect0:0:10:10/metadata.jpg", http.StatusBadRequest},
+		{"/300x300/crop/c,b20k/metadata.jpg", http.StatusOK},
+		{"/metadata.jpg?w=300&q=80", http.StatusBadRequest},
+		{"/300x300/crop/c,b20480/metadata.jpg", http.StatusOK},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: expected %d, got %d", test.url, test.status, w.Code)
+		}
+	}
+	// b20480 is cached as b20k
+	if tiers := api.Tiers.Size(); tiers != 3 {
+		t.Errorf("expected 3 tiers, got %d", tiers)
+	}
+}
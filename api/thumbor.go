@@ -0,0 +1,241 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/auth"
+	"github.com/kxlt/imageresizer/config"
+	"github.com/rcrowley/go-metrics"
+)
+
+// Thumbor URLs are
+// /{unsafe|signature}/[trim/][AxB:CxD/][fit-in/][-]Wx[-]H/[halign/][valign/][smart/][filters:.../]{path}
+var (
+	thumborSignatureRegexp = regexp.MustCompile("^[A-Za-z0-9_-]{27}=$") // url safe base64 HMAC-SHA1
+	thumborCropRegexp      = regexp.MustCompile("^([0-9]+)x([0-9]+):([0-9]+)x([0-9]+)$")
+	thumborSizeRegexp      = regexp.MustCompile("^(-?)([0-9]*)x(-?)([0-9]*)$")
+	thumborFilterRegexp    = regexp.MustCompile("^([a-z_]+)\\((.*)\\)$")
+	thumborColorRegexp     = regexp.MustCompile("^[0-9a-f]{6}$")
+)
+
+// thumborUnbounded replaces the dimensions left to Thumbor to compute, e.g.
+// the height of 300x0, so the other one sets the size. It's bounded by the
+// sizes policy, see allowedDimension.
+const thumborUnbounded = 20000
+
+// thumborColors maps the fill filter color names to extend settings.
+var thumborColors = map[string]string{
+	"white": "ffffff",
+	"black": "000000",
+}
+
+// thumborGravities maps the halign and valign of Thumbor URLs to gravities.
+var thumborGravities = map[string]string{
+	"left/top":      "nw",
+	"center/top":    "n",
+	"right/top":     "ne",
+	"left/middle":   "w",
+	"center/middle": "c",
+	"right/middle":  "e",
+	"left/bottom":   "sw",
+	"center/bottom": "south",
+	"right/bottom":  "se",
+}
+
+// isThumborURL matches the Thumbor URLs under thumbor.prefix
+func isThumborURL(r *http.Request, rm *mux.RouteMatch) bool {
+	urlPath := strings.TrimPrefix(r.URL.EscapedPath(), config.C.ThumborPrefix+"/")
+	signature := strings.SplitN(urlPath, "/", 2)[0]
+	return signature == "unsafe" || thumborSignatureRegexp.MatchString(signature)
+}
+
+// serveThumbor serves Thumbor URLs as the equivalent thumbnail path, sharing
+// its cached thumbnails. unsafe URLs must also be signed like thumbnail URLs
+// when signature keys are configured. The original's path is only known once
+// the URL is parsed, so the vary and etag middlewares run here, after the URL
+// is verified and authorized.
+func (api *Api) serveThumbor() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := metrics.GetOrRegisterTimer("api.thumbor.latency", nil)
+		t.Time(func() {
+			urlPath := strings.TrimPrefix(r.URL.EscapedPath(), config.C.ThumborPrefix+"/")
+			parts := strings.SplitN(urlPath, "/", 2)
+			if len(parts) != 2 {
+				respondWithErr(w, http.StatusNotFound)
+				return
+			}
+			if !thumborAuthorized(parts[0], parts[1]) || parts[0] == "unsafe" && !validSignature(r) {
+				respondWithErr(w, http.StatusForbidden)
+				return
+			}
+			unescaped, err := url.PathUnescape(parts[1])
+			if err != nil {
+				respondWithErr(w, http.StatusBadRequest)
+				return
+			}
+			vars, err := thumborVars(strings.Split(unescaped, "/"))
+			if err != nil {
+				respondWithErr(w, http.StatusBadRequest)
+				return
+			}
+			if !api.authorize(w, r, auth.READ, vars["path"]) {
+				return
+			}
+			// the format filter pins the output format
+			pinsFormat := func(*http.Request) bool { return vars["format"] != "" }
+			api.varyMiddleware(pinsFormat, api.etagMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				api.serveTransform(w, r, vars, nil)
+			}))(w, r)
+		})
+	}
+}
+
+// thumborAuthorized reports whether urlPath may be served: signature is
+// either unsafe, when thumbor.unsafe is set, or its HMAC-SHA1 with thumbor.key
+func thumborAuthorized(signature string, urlPath string) bool {
+	if signature == "unsafe" {
+		return config.C.ThumborUnsafe
+	}
+	if config.C.ThumborKey == "" {
+		return false
+	}
+	mac := hmac.New(sha1.New, []byte(config.C.ThumborKey))
+	mac.Write([]byte(urlPath))
+	expected := base64.URLEncoding.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(signature), []byte(expected))
+}
+
+// thumborVars translates the segments of a Thumbor URL following the
+// signature into the route vars of the equivalent thumbnail path. Trimming,
+// flips and most filters aren't supported.
+func thumborVars(segments []string) (map[string]string, error) {
+	i := 0
+	if i < len(segments) && (segments[i] == "trim" || strings.HasPrefix(segments[i], "trim:")) {
+		return nil, errors.New("trim isn't supported")
+	}
+	rect := ""
+	if i < len(segments) && thumborCropRegexp.MatchString(segments[i]) {
+		// left x top : right x bottom
+		crop := thumborCropRegexp.FindStringSubmatch(segments[i])
+		var coords [4]int
+		for j := range coords {
+			coords[j], _ = strconv.Atoi(crop[j+1])
+		}
+		if coords[2] <= coords[0] || coords[3] <= coords[1] {
+			return nil, errors.New("invalid manual crop")
+		}
+		rect = fmt.Sprintf("rect%d:%d:%d:%d", coords[0], coords[1], coords[2]-coords[0], coords[3]-coords[1])
+		i++
+	}
+	fitIn := false
+	if i < len(segments) && segments[i] == "fit-in" {
+		fitIn = true
+		i++
+	}
+	if i >= len(segments) {
+		return nil, errors.New("missing size")
+	}
+	size := thumborSizeRegexp.FindStringSubmatch(segments[i])
+	if size == nil {
+		return nil, errors.New("missing size")
+	}
+	if size[1] != "" || size[3] != "" {
+		return nil, errors.New("flips aren't supported")
+	}
+	width, _ := strconv.Atoi(size[2])
+	height, _ := strconv.Atoi(size[4])
+	if width == 0 && height == 0 {
+		return nil, errors.New("missing size")
+	}
+	i++
+
+	halign, valign := "center", "middle"
+	if i < len(segments) && (segments[i] == "left" || segments[i] == "center" || segments[i] == "right") {
+		halign = segments[i]
+		i++
+	}
+	if i < len(segments) && (segments[i] == "top" || segments[i] == "middle" || segments[i] == "bottom") {
+		valign = segments[i]
+		i++
+	}
+	gravity := thumborGravities[halign+"/"+valign]
+	if i < len(segments) && segments[i] == "smart" {
+		gravity = "s"
+		i++
+	}
+	var filters []string
+	if i < len(segments) && strings.HasPrefix(segments[i], "filters:") {
+		filters = strings.Split(strings.TrimPrefix(segments[i], "filters:"), ":")
+		i++
+	}
+	if i >= len(segments) {
+		return nil, errors.New("missing image")
+	}
+
+	vars := map[string]string{
+		"width":    strconv.Itoa(width),
+		"height":   strconv.Itoa(height),
+		"resizeOp": "crop",
+		"path":     strings.Join(segments[i:], "/"),
+	}
+	opts := []string{gravity}
+	if fitIn || width == 0 || height == 0 {
+		vars["resizeOp"] = "fit"
+		opts[0] = "0"
+	}
+	if rect != "" {
+		opts = append(opts, rect)
+	}
+	if width == 0 {
+		vars["width"] = strconv.Itoa(allowedDimension(thumborUnbounded))
+	}
+	if height == 0 {
+		vars["height"] = strconv.Itoa(allowedDimension(thumborUnbounded))
+	}
+	for _, filter := range filters {
+		match := thumborFilterRegexp.FindStringSubmatch(filter)
+		if match == nil {
+			return nil, errors.New("invalid filter")
+		}
+		switch name, arg := match[1], match[2]; name {
+		case "quality":
+			quality, err := strconv.Atoi(arg)
+			if err != nil {
+				return nil, errors.New("invalid quality")
+			}
+			opts = append(opts, "q"+strconv.Itoa(quality))
+		case "format":
+			if arg == "jpeg" {
+				arg = "jpg"
+			}
+			vars["format"] = arg
+		case "fill":
+			// only fit-in thumbnails of both dimensions are filled
+			if !fitIn || width == 0 || height == 0 {
+				continue
+			}
+			color, ok := thumborColors[arg]
+			if !ok {
+				color = strings.ToLower(strings.TrimPrefix(arg, "#"))
+			}
+			if !thumborColorRegexp.MatchString(color) {
+				return nil, errors.New("unsupported fill color")
+			}
+			opts[0] = color
+		default:
+			return nil, errors.New("unsupported filter")
+		}
+	}
+	vars["options"] = strings.Join(opts, ",")
+	return vars, nil
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/kxlt/imageresizer/collections"
+	"github.com/kxlt/imageresizer/config"
+	"github.com/kxlt/imageresizer/store"
+)
+
+func TestThumborVars(t *testing.T) {
+	tests := []struct {
+		url  string
+		vars map[string]string
+	}{
+		{"300x200/smart/path.jpg", map[string]string{
+			"width": "300", "height": "200", "resizeOp": "crop", "options": "s", "path": "path.jpg",
+		}},
+		{"fit-in/300x200/filters:quality(80)/dir/path.jpg", map[string]string{
+			"width": "300", "height": "200", "resizeOp": "fit", "options": "0,q80", "path": "dir/path.jpg",
+		}},
+		{"fit-in/300x200/left/top/filters:fill(white):format(jpeg)/path.png", map[string]string{
+			"width": "300", "height": "200", "resizeOp": "fit", "options": "ffffff", "path": "path.png", "format": "jpg",
+		}},
+		{"300x0/center/middle/path.jpg", map[string]string{
+			"width": "300", "height": "20000", "resizeOp": "fit", "options": "0", "path": "path.jpg",
+		}},
+		{"x200/filters:fill(000000)/path.jpg", map[string]string{
+			"width": "20000", "height": "200", "resizeOp": "fit", "options": "0", "path": "path.jpg",
+		}},
+		{"10x10:90x60/300x200/path.jpg", map[string]string{
+			"width": "300", "height": "200", "resizeOp": "crop", "options": "c,rect10:10:80:50", "path": "path.jpg",
+		}},
+		{"300x200/right/bottom/path.jpg", map[string]string{
+			"width": "300", "height": "200", "resizeOp": "crop", "options": "se", "path": "path.jpg",
+		}},
+		{"300x200/top/path.jpg", map[string]string{
+			"width": "300", "height": "200", "resizeOp": "crop", "options": "n", "path": "path.jpg",
+		}},
+		{"300x200/left/smart/path.jpg", map[string]string{
+			"width": "300", "height": "200", "resizeOp": "crop", "options": "s", "path": "path.jpg",
+		}},
+		{"90x90:10x10/300x200/path.jpg", nil},
+		{"-300x200/path.jpg", nil},
+		{"0x0/path.jpg", nil},
+		{"trim/300x200/path.jpg", nil},
+		{"trim:top-left/300x200/path.jpg", nil},
+		{"path.jpg", nil},
+		{"300x200/filters:blur(7)/path.jpg", nil},
+		{"fit-in/300x200/filters:fill(blur)/path.jpg", nil},
+		{"300x200/smart", nil},
+	}
+	for _, test := range tests {
+		vars, err := thumborVars(strings.Split(test.url, "/"))
+		if test.vars == nil {
+			if err == nil {
+				t.Errorf("%s: expected error", test.url)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(vars, test.vars) {
+			t.Errorf("%s: expected %v, got %v (%v)", test.url, test.vars, vars, err)
+		}
+	}
+}
+
+func TestServeThumbor(t *testing.T) {
+	defer func(c config.Config) { config.C = c }(config.C)
+	config.C.ThumborEnable = true
+	config.C.ThumborPrefix = "/thumbor"
+	config.C.ThumborKey = "MY_SECURE_KEY"
+	config.C.SizesStep = 10
+	config.C.SizesMax = 1000
+
+	api := newTestApi()
+	api.Originals = &store.TwoTier{Store: store.NewFileStore("../testdata")}
+	api.Thumbnails = &store.NoopCache{}
+	api.Tiers = collections.NewSyncStrSet()
+	api.Etags = collections.NewSyncStrSet()
+	api.Router = mux.NewRouter()
+	api.routes()
+
+	// HMAC-SHA1 of 30x20/smart/samuel-clara-69657-unsplash.jpg with MY_SECURE_KEY
+	signed := "/thumbor/rm-5GyMOmr9sw-CGVzNlQw8lsJI=/30x20/smart/samuel-clara-69657-unsplash.jpg"
+	tests := []struct {
+		unsafe bool
+		url    string
+		status int
+	}{
+		{true, "/thumbor/unsafe/30x20/smart/samuel-clara-69657-unsplash.jpg", http.StatusOK},
+		{false, "/thumbor/unsafe/30x20/smart/samuel-clara-69657-unsplash.jpg", http.StatusForbidden},
+		{false, signed, http.StatusOK},
+		{false, strings.Replace(signed, "30x20", "40x20", 1), http.StatusForbidden},
+		{true, "/thumbor/unsafe/-30x20/samuel-clara-69657-unsplash.jpg", http.StatusBadRequest},
+		// the height is bounded by sizes.max
+		{true, "/thumbor/unsafe/30x0/samuel-clara-69657-unsplash.jpg", http.StatusOK},
+		{true, "/thumbor/unsafe/trim/30x20/samuel-clara-69657-unsplash.jpg", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		config.C.ThumborUnsafe = test.unsafe
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.url, test.status, w.Code)
+		}
+	}
+	if !api.Tiers.Contains("30x20/crop/s") {
+		t.Errorf("Thumbor thumbnail not cached under the canonical tier")
+	}
+}
@@ -0,0 +1,91 @@
+// Package auth authenticates requests with static API keys or HS256/RS256
+// JWT bearer tokens, and authorizes them by scope and path prefix.
+package auth
+
+import (
+	"crypto/rsa"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// Scopes
+const (
+	READ   = "read"
+	UPLOAD = "upload"
+	DELETE = "delete"
+)
+
+var (
+	ErrNoCredentials      = errors.New("no credentials")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Grant is what a key or token is allowed to do: the scopes it has, on the
+// paths starting with any of its prefixes, or on every path without prefixes.
+type Grant struct {
+	Scopes   []string
+	Prefixes []string
+}
+
+// Allows reports whether the grant has scope on filePath.
+func (g *Grant) Allows(scope string, filePath string) bool {
+	hasScope := false
+	for _, s := range g.Scopes {
+		if s == scope {
+			hasScope = true
+			break
+		}
+	}
+	if !hasScope {
+		return false
+	}
+	if len(g.Prefixes) == 0 {
+		return true
+	}
+	filePath = strings.TrimPrefix(path.Clean("/"+filePath), "/")
+	for _, prefix := range g.Prefixes {
+		if strings.HasPrefix(filePath, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type Authenticator struct {
+	keys      map[string]*Grant // by API key
+	secret    []byte            // HS256
+	publicKey *rsa.PublicKey    // RS256
+}
+
+// New returns an Authenticator accepting the API keys in keys, and JWTs
+// signed with secret or publicKey when they're set.
+func New(keys map[string]*Grant, secret []byte, publicKey *rsa.PublicKey) *Authenticator {
+	return &Authenticator{
+		keys:      keys,
+		secret:    secret,
+		publicKey: publicKey,
+	}
+}
+
+// Authenticate returns the grant of the API key or JWT in the Authorization
+// bearer header of r.
+func (a *Authenticator) Authenticate(r *http.Request, now time.Time) (*Grant, error) {
+	authorization := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return nil, ErrNoCredentials
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	if strings.Count(token, ".") == 2 {
+		return a.verifyJWT(token, now)
+	}
+	for key, grant := range a.keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+			return grant, nil
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func makeJWT(t *testing.T, alg string, claims map[string]interface{}, sign func([]byte) []byte) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("could not encode claims: %v", err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(signed)))
+}
+
+func hs256(secret []byte) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(signed)
+		return mac.Sum(nil)
+	}
+}
+
+func rs256(t *testing.T, key *rsa.PrivateKey) func([]byte) []byte {
+	return func(signed []byte) []byte {
+		hash := sha256.Sum256(signed)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatalf("could not sign token: %v", err)
+		}
+		return signature
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	now := time.Unix(1546300800, 0)
+	secret := []byte("secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate RSA key: %v", err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate RSA key: %v", err)
+	}
+	a := New(map[string]*Grant{
+		"ci-key": {Scopes: []string{UPLOAD, DELETE}, Prefixes: []string{"products/"}},
+	}, secret, &rsaKey.PublicKey)
+
+	claims := map[string]interface{}{
+		"exp":      now.Add(time.Hour).Unix(),
+		"scope":    "read upload",
+		"prefixes": []string{"users/"},
+	}
+	expired := map[string]interface{}{"exp": now.Add(-time.Hour).Unix(), "scope": "read"}
+	notYet := map[string]interface{}{"nbf": now.Add(time.Hour).Unix(), "scope": "read"}
+
+	tests := []struct {
+		name          string
+		authorization string
+		err           error
+		scopes        int
+	}{
+		{"no header", "", ErrNoCredentials, 0},
+		{"basic auth", "Basic dXNlcjpwYXNz", ErrNoCredentials, 0},
+		{"api key", "Bearer ci-key", nil, 2},
+		{"unknown api key", "Bearer other-key", ErrInvalidCredentials, 0},
+		{"HS256", "Bearer " + makeJWT(t, "HS256", claims, hs256(secret)), nil, 2},
+		{"HS256 wrong secret", "Bearer " + makeJWT(t, "HS256", claims, hs256([]byte("x"))), ErrInvalidCredentials, 0},
+		{"RS256", "Bearer " + makeJWT(t, "RS256", claims, rs256(t, rsaKey)), nil, 2},
+		{"RS256 wrong key", "Bearer " + makeJWT(t, "RS256", claims, rs256(t, otherKey)), ErrInvalidCredentials, 0},
+		{"alg none", "Bearer " + makeJWT(t, "none", claims, func([]byte) []byte { return nil }), ErrInvalidCredentials, 0},
+		{"expired", "Bearer " + makeJWT(t, "HS256", expired, hs256(secret)), ErrInvalidCredentials, 0},
+		{"not before", "Bearer " + makeJWT(t, "HS256", notYet, hs256(secret)), ErrInvalidCredentials, 0},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/products/photo.jpg", nil)
+		if test.authorization != "" {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		grant, err := a.Authenticate(r, now)
+		if err != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+			continue
+		}
+		if err == nil && len(grant.Scopes) != test.scopes {
+			t.Errorf("%s: expected %d scopes, got %v", test.name, test.scopes, grant.Scopes)
+		}
+	}
+}
+
+func TestGrant_Allows(t *testing.T) {
+	grant := &Grant{Scopes: []string{UPLOAD}, Prefixes: []string{"products/", "users/42/"}}
+	tests := []struct {
+		scope    string
+		filePath string
+		allowed  bool
+	}{
+		{UPLOAD, "products/photo.jpg", true},
+		{UPLOAD, "users/42/avatar.png", true},
+		{UPLOAD, "users/43/avatar.png", false},
+		{UPLOAD, "products/../users/43/avatar.png", false},
+		{DELETE, "products/photo.jpg", false},
+	}
+	for _, test := range tests {
+		if allowed := grant.Allows(test.scope, test.filePath); allowed != test.allowed {
+			t.Errorf("%s %s: expected %v", test.scope, test.filePath, test.allowed)
+		}
+	}
+	if !(&Grant{Scopes: []string{READ}}).Allows(READ, "any/photo.jpg") {
+		t.Errorf("grant without prefixes should allow every path")
+	}
+}
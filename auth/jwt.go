@@ -0,0 +1,107 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"time"
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+}
+
+// jwtClaims are the claims read from tokens. Scopes are space separated, as
+// in OAuth 2.0, and prefixes restrict the paths the token is valid for.
+type jwtClaims struct {
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+	Scope     string   `json:"scope"`
+	Prefixes  []string `json:"prefixes"`
+}
+
+func (a *Authenticator) verifyJWT(token string, now time.Time) (*Grant, error) {
+	parts := strings.Split(token, ".")
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch header.Alg {
+	case "HS256":
+		if a.secret == nil {
+			return nil, ErrInvalidCredentials
+		}
+		mac := hmac.New(sha256.New, a.secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return nil, ErrInvalidCredentials
+		}
+	case "RS256":
+		if a.publicKey == nil {
+			return nil, ErrInvalidCredentials
+		}
+		hash := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(a.publicKey, crypto.SHA256, hash[:], signature) != nil {
+			return nil, ErrInvalidCredentials
+		}
+	default:
+		// notably "none"
+		return nil, ErrInvalidCredentials
+	}
+
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	if claims.ExpiresAt > 0 && now.Unix() >= claims.ExpiresAt {
+		return nil, ErrInvalidCredentials
+	}
+	if claims.NotBefore > 0 && now.Unix() < claims.NotBefore {
+		return nil, ErrInvalidCredentials
+	}
+	return &Grant{
+		Scopes:   strings.Fields(claims.Scope),
+		Prefixes: claims.Prefixes,
+	}, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	buf, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buf, v)
+}
+
+// ParseRSAPublicKey parses a PEM encoded RSA public key, in PKIX or PKCS #1
+// form.
+func ParseRSAPublicKey(buf []byte) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode(buf)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("not an RSA public key")
+	}
+	return rsaKey, nil
+}
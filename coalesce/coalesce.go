@@ -0,0 +1,56 @@
+package coalesce
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrPanicked is returned to the callers waiting for a call whose fn
+// panicked. The panic itself is propagated to the caller that ran fn.
+var ErrPanicked = errors.New("coalesce: call panicked")
+
+// Group coalesces concurrent calls sharing a key, so only the first one runs
+// and the others wait for its result. The zero value is ready to use.
+type Group struct {
+	calls map[string]*call
+	sync.Mutex
+}
+
+type call struct {
+	val interface{}
+	err error
+	sync.WaitGroup
+}
+
+// Do runs fn and returns its result, unless a call with the same key is in
+// flight, in which case it waits for that call and returns its result
+// instead. shared is true when the result was given to more than one caller.
+func (g *Group) Do(key string, fn func() (interface{}, error)) (val interface{}, err error, shared bool) {
+	g.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+	if c, ok := g.calls[key]; ok {
+		g.Unlock()
+		c.Wait()
+		return c.val, c.err, true
+	}
+	c := &call{}
+	c.Add(1)
+	g.calls[key] = c
+	g.Unlock()
+
+	returned := false
+	defer func() {
+		if !returned {
+			c.val, c.err = nil, ErrPanicked
+		}
+		g.Lock()
+		delete(g.calls, key)
+		g.Unlock()
+		c.Done()
+	}()
+	c.val, c.err = fn()
+	returned = true
+	return c.val, c.err, false
+}
@@ -0,0 +1,104 @@
+package coalesce
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGroup_Do(t *testing.T) {
+	var g Group
+	val, err, shared := g.Do("key", func() (interface{}, error) {
+		return "val", nil
+	})
+	if val.(string) != "val" || err != nil || shared {
+		t.Errorf("Unexpected result: %v, %v, %v", val, err, shared)
+	}
+
+	expectedErr := errors.New("err")
+	_, err, _ = g.Do("key", func() (interface{}, error) {
+		return nil, expectedErr
+	})
+	if err != expectedErr {
+		t.Errorf("Expected %v, got %v", expectedErr, err)
+	}
+}
+
+func TestGroup_DoConcurrent(t *testing.T) {
+	var (
+		g     Group
+		calls int32
+		wg    sync.WaitGroup
+	)
+	release := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			val, _, _ := g.Do("key", func() (interface{}, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return "val", nil
+			})
+			if val.(string) != "val" {
+				t.Errorf("Unexpected value: %v", val)
+			}
+		}()
+	}
+	// let the goroutines pile up behind the first call
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("Expected 1 call, got %d", calls)
+	}
+
+	g.Do("key", func() (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		return nil, nil
+	})
+	if calls != 2 {
+		t.Errorf("Expected a new call once the first one finished")
+	}
+}
+
+func TestGroup_DoPanic(t *testing.T) {
+	var g Group
+	started := make(chan struct{})
+	release := make(chan struct{})
+	waited := make(chan error)
+	go func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("Expected the panic to propagate")
+			}
+		}()
+		g.Do("key", func() (interface{}, error) {
+			close(started)
+			<-release
+			panic("fn")
+		})
+	}()
+	<-started
+	go func() {
+		_, err, _ := g.Do("key", func() (interface{}, error) {
+			return "val", nil
+		})
+		waited <- err
+	}()
+	// let the second call wait for the first one
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if err := <-waited; err != ErrPanicked {
+		t.Errorf("Expected %v, got %v", ErrPanicked, err)
+	}
+
+	val, err, _ := g.Do("key", func() (interface{}, error) {
+		return "val", nil
+	})
+	if val != "val" || err != nil {
+		t.Errorf("Expected a new call after the panic, got %v, %v", val, err)
+	}
+}
@@ -34,6 +34,72 @@ type Config struct {
 
 	EtagCacheEnable  bool
 	EtagCacheMaxSize int
+
+	EncodeJPEGQuality     int
+	EncodeJPEGProgressive bool
+	EncodePNGCompression  int
+	EncodeWebPQuality     int
+	EncodeAVIFQuality     int
+
+	MetadataPolicy string
+
+	ColorConvert bool
+
+	AnimationEnable        bool
+	AnimationMaxFrames     int
+	AnimationMaxMegapixels int
+
+	LimitsMaxWidth      int
+	LimitsMaxHeight     int
+	LimitsMaxMegapixels int
+	LimitsMaxPages      int
+
+	ImagerTimeout           int
+	ImagerWorkers           int
+	ImagerQueueSize         int
+	ImagerRetryAfter        int
+	ImagerVipsConcurrency   int
+	ImagerVipsCacheMax      int
+	ImagerVipsCacheMaxMem   int64
+	ImagerVipsCacheMaxFiles int
+
+	Presets map[string]string
+
+	SizesAllowed  []Size
+	SizesStep     int
+	SizesMax      int
+	SizesOptions  []string
+	SizesRedirect bool
+	SizesEnlarge  bool
+
+	SignatureKeys []string
+
+	AuthRequired     []string
+	AuthKeys         map[string]AuthKey
+	AuthJWTSecret    string
+	AuthJWTPublicKey string
+
+	ThumborEnable bool
+	ThumborPrefix string
+	ThumborKey    string
+	ThumborUnsafe bool
+
+	IIIFEnable  bool
+	IIIFPrefix  string
+	IIIFMaxArea int
+}
+
+// AuthKey is a static API key, with the scopes it grants on the paths
+// starting with any of its prefixes, or on every path without prefixes.
+type AuthKey struct {
+	Key      string
+	Scopes   []string
+	Prefixes []string
+}
+
+type Size struct {
+	Width  int
+	Height int
 }
 
 var C Config
@@ -61,6 +127,45 @@ func init() {
 	viper.SetDefault("upload.maxsize", "50M")
 	viper.SetDefault("etag.cache.enable", true)
 	viper.SetDefault("etag.cache.maxsize", 50000)
+	viper.SetDefault("encode.jpeg.quality", 80)
+	viper.SetDefault("encode.jpeg.progressive", false)
+	viper.SetDefault("encode.png.compression", 6)
+	viper.SetDefault("encode.webp.quality", 80)
+	viper.SetDefault("encode.avif.quality", 50)
+	viper.SetDefault("metadata.policy", "strip")
+	viper.SetDefault("color.convert", true)
+	viper.SetDefault("animation.enable", true)
+	viper.SetDefault("animation.maxframes", 100)
+	viper.SetDefault("animation.maxmegapixels", 50)
+	viper.SetDefault("limits.maxwidth", 20000)
+	viper.SetDefault("limits.maxheight", 20000)
+	viper.SetDefault("limits.maxmegapixels", 200)
+	viper.SetDefault("limits.maxpages", 1000)
+	viper.SetDefault("imager.timeout", 30000)
+	viper.SetDefault("imager.workers", 0)
+	viper.SetDefault("imager.queue", 100)
+	viper.SetDefault("imager.retryafter", 1)
+	viper.SetDefault("imager.vips.concurrency", 0)
+	viper.SetDefault("imager.vips.cache.max", 100)
+	viper.SetDefault("imager.vips.cache.maxmem", "100M")
+	viper.SetDefault("imager.vips.cache.maxfiles", 100)
+	viper.SetDefault("sizes.allowed", "")
+	viper.SetDefault("sizes.step", 0)
+	viper.SetDefault("sizes.max", 0)
+	viper.SetDefault("sizes.options", "")
+	viper.SetDefault("sizes.redirect", false)
+	viper.SetDefault("sizes.enlarge", true)
+	viper.SetDefault("signature.keys", "")
+	viper.SetDefault("auth.required", "")
+	viper.SetDefault("auth.jwt.secret", "")
+	viper.SetDefault("auth.jwt.publickey", "")
+	viper.SetDefault("thumbor.enable", false)
+	viper.SetDefault("thumbor.prefix", "/thumbor")
+	viper.SetDefault("thumbor.key", "")
+	viper.SetDefault("thumbor.unsafe", false)
+	viper.SetDefault("iiif.enable", false)
+	viper.SetDefault("iiif.prefix", "/iiif")
+	viper.SetDefault("iiif.maxarea", 16000000)
 }
 
 func RefreshConfig() {
@@ -90,6 +195,136 @@ func RefreshConfig() {
 	C.UploadMaxSize = parseSize(viper.GetString("upload.maxsize"))
 	C.EtagCacheEnable = viper.GetBool("etag.cache.enable")
 	C.EtagCacheMaxSize = viper.GetInt("etag.cache.maxsize")
+	C.EncodeJPEGQuality = parseQuality(viper.GetInt("encode.jpeg.quality"))
+	C.EncodeJPEGProgressive = viper.GetBool("encode.jpeg.progressive")
+	C.EncodePNGCompression = viper.GetInt("encode.png.compression")
+	if C.EncodePNGCompression < 1 || C.EncodePNGCompression > 9 {
+		log.Fatalln("PNG compression level must be between 1 and 9")
+	}
+	C.EncodeWebPQuality = parseQuality(viper.GetInt("encode.webp.quality"))
+	C.EncodeAVIFQuality = parseQuality(viper.GetInt("encode.avif.quality"))
+	C.MetadataPolicy = viper.GetString("metadata.policy")
+	switch C.MetadataPolicy {
+	case "strip", "icc", "copyright", "nogps":
+	default:
+		log.Fatalln("Metadata policy must be one of strip, icc, copyright or nogps")
+	}
+	C.ColorConvert = viper.GetBool("color.convert")
+	C.AnimationEnable = viper.GetBool("animation.enable")
+	C.AnimationMaxFrames = viper.GetInt("animation.maxframes")
+	C.AnimationMaxMegapixels = viper.GetInt("animation.maxmegapixels")
+	C.LimitsMaxWidth = viper.GetInt("limits.maxwidth")
+	C.LimitsMaxHeight = viper.GetInt("limits.maxheight")
+	C.LimitsMaxMegapixels = viper.GetInt("limits.maxmegapixels")
+	C.LimitsMaxPages = viper.GetInt("limits.maxpages")
+	C.ImagerTimeout = viper.GetInt("imager.timeout")
+	C.ImagerWorkers = viper.GetInt("imager.workers")
+	C.ImagerQueueSize = viper.GetInt("imager.queue")
+	if C.ImagerQueueSize < 0 {
+		log.Fatalln("Imager queue size can't be negative")
+	}
+	C.ImagerRetryAfter = viper.GetInt("imager.retryafter")
+	C.ImagerVipsConcurrency = viper.GetInt("imager.vips.concurrency")
+	C.ImagerVipsCacheMax = viper.GetInt("imager.vips.cache.max")
+	C.ImagerVipsCacheMaxMem = parseSize(viper.GetString("imager.vips.cache.maxmem"))
+	C.ImagerVipsCacheMaxFiles = viper.GetInt("imager.vips.cache.maxfiles")
+	C.Presets = viper.GetStringMapString("presets")
+	C.SizesAllowed = parseSizes(viper.GetString("sizes.allowed"))
+	C.SizesStep = viper.GetInt("sizes.step")
+	C.SizesMax = viper.GetInt("sizes.max")
+	if C.SizesStep < 0 || C.SizesMax < 0 || C.SizesMax > 0 && C.SizesMax < C.SizesStep {
+		log.Fatalln("Size step and max must be positive, and max at least one step")
+	}
+	C.SizesOptions = parseList(viper.GetString("sizes.options"))
+	C.SizesRedirect = viper.GetBool("sizes.redirect")
+	C.SizesEnlarge = viper.GetBool("sizes.enlarge")
+	C.SignatureKeys = parseList(viper.GetString("signature.keys"))
+	C.AuthRequired = parseScopes(viper.GetString("auth.required"))
+	C.AuthKeys = make(map[string]AuthKey)
+	for name := range viper.GetStringMap("auth.keys") {
+		key := AuthKey{
+			Key:      viper.GetString("auth.keys." + name + ".key"),
+			Scopes:   parseScopes(viper.GetString("auth.keys." + name + ".scopes")),
+			Prefixes: parseList(viper.GetString("auth.keys." + name + ".prefixes")),
+		}
+		if key.Key == "" {
+			log.Fatalf("API key %s is empty\n", name)
+		}
+		C.AuthKeys[name] = key
+	}
+	C.AuthJWTSecret = viper.GetString("auth.jwt.secret")
+	C.AuthJWTPublicKey = viper.GetString("auth.jwt.publickey")
+	C.ThumborEnable = viper.GetBool("thumbor.enable")
+	C.ThumborPrefix = strings.TrimSuffix(viper.GetString("thumbor.prefix"), "/")
+	if C.ThumborPrefix != "" && !strings.HasPrefix(C.ThumborPrefix, "/") {
+		log.Fatalln("Thumbor prefix must start with /")
+	}
+	C.ThumborKey = viper.GetString("thumbor.key")
+	C.ThumborUnsafe = viper.GetBool("thumbor.unsafe")
+	C.IIIFEnable = viper.GetBool("iiif.enable")
+	C.IIIFPrefix = strings.TrimSuffix(viper.GetString("iiif.prefix"), "/")
+	if !strings.HasPrefix(C.IIIFPrefix, "/") {
+		log.Fatalln("IIIF prefix must start with /")
+	}
+	C.IIIFMaxArea = viper.GetInt("iiif.maxarea")
+	if C.IIIFMaxArea < 0 {
+		log.Fatalln("IIIF max area can't be negative")
+	}
+}
+
+// parseList parses a comma separated list, ignoring empty items
+func parseList(listStr string) []string {
+	var list []string
+	for _, item := range strings.Split(listStr, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func parseScopes(scopesStr string) []string {
+	scopes := parseList(scopesStr)
+	for _, scope := range scopes {
+		switch scope {
+		case "read", "upload", "delete":
+		default:
+			log.Fatalln("Auth scopes must be read, upload or delete")
+		}
+	}
+	return scopes
+}
+
+// parseSizes parses a comma separated list of sizes, e.g. 300x300,480x640
+func parseSizes(sizesStr string) []Size {
+	var sizes []Size
+	for _, sizeStr := range strings.Split(sizesStr, ",") {
+		sizeStr = strings.TrimSpace(sizeStr)
+		if sizeStr == "" {
+			continue
+		}
+		dimensions := strings.Split(sizeStr, "x")
+		if len(dimensions) != 2 {
+			log.Fatalln("Could not parse config sizes")
+		}
+		width, err := strconv.Atoi(dimensions[0])
+		if err != nil || width < 1 {
+			log.Fatalln("Could not parse config sizes")
+		}
+		height, err := strconv.Atoi(dimensions[1])
+		if err != nil || height < 1 {
+			log.Fatalln("Could not parse config sizes")
+		}
+		sizes = append(sizes, Size{Width: width, Height: height})
+	}
+	return sizes
+}
+
+func parseQuality(quality int) int {
+	if quality < 1 || quality > 100 {
+		log.Fatalln("Encoder quality must be between 1 and 100")
+	}
+	return quality
 }
 
 func parseSize(sizeStr string) int64 {
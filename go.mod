@@ -9,4 +9,5 @@ require (
 	github.com/pkg/errors v0.8.0 // indirect
 	github.com/rcrowley/go-metrics v0.0.0-20181016184325-3113b8401b8a
 	github.com/spf13/viper v1.2.1
+	golang.org/x/image v0.0.0-20181116024801-cd38e8056d9b
 )
@@ -0,0 +1,36 @@
+package imager
+
+// isAnimation reports whether an imageType original with the given number of
+// pages is an animation.
+func isAnimation(imageType ImageType, pages int) bool {
+	return pages > 1 && (imageType == GIF || imageType == WEBP)
+}
+
+// animationSaveType returns the format the thumbnail of an animation is
+// encoded in. AVIF animations aren't supported, so WebP is used instead: every
+// client accepting AVIF accepts WebP too.
+func animationSaveType(format ImageType) ImageType {
+	if format == AVIF && savers[WEBP] {
+		return WEBP
+	}
+	return format
+}
+
+// animate reports whether every frame of an animation is resized. Otherwise
+// only the first frame is, e.g. when the output format can't be animated, the
+// animation is too big to resize or an extend background, a region, a
+// rotation or an anchored crop is requested.
+func (c Config) animate(format ImageType, width int, height int, pages int, options Options) bool {
+	if !c.AnimationEnable || len(options.ExtendBackground) > 0 {
+		return false
+	}
+	// frames are a tall strip, which can't be cropped or rotated as a whole
+	if !options.Region.Empty() || rotation(options.Rotate) != 0 || anchoredCrop(options) {
+		return false
+	}
+	if format != GIF && format != WEBP {
+		return false
+	}
+	return pages <= c.AnimationMaxFrames &&
+		int64(width)*int64(height)*int64(pages) <= int64(c.AnimationMaxMegapixels)*1000000
+}
@@ -0,0 +1,37 @@
+package imager
+
+import "time"
+
+// Config holds the settings of an Imager, set once when it's created. Zero
+// limits, timeout and libvips settings disable them or keep the libvips
+// defaults.
+type Config struct {
+	// Encoder defaults, used when Options don't set them
+	JPEGQuality     int // 1-100
+	JPEGProgressive bool
+	PNGCompression  int // zlib compression level 1-9
+	WebPQuality     int // 1-100
+	AVIFQuality     int // 1-100
+
+	// Limits checked against the header of originals
+	MaxWidth      int
+	MaxHeight     int
+	MaxMegapixels int // every frame of an animation counts
+	MaxPages      int
+
+	AnimationEnable        bool
+	AnimationMaxFrames     int
+	AnimationMaxMegapixels int
+
+	ColorConvert   bool // convert to sRGB, or Display P3 with Options.WideGamut
+	MetadataPolicy MetadataPolicyType
+
+	// Vips worker pool and libvips settings
+	Timeout           time.Duration // queue wait and resize
+	Workers           int           // 0 starts one per CPU
+	QueueSize         int
+	VipsConcurrency   int
+	VipsCacheMax      int
+	VipsCacheMaxMem   int64
+	VipsCacheMaxFiles int
+}
@@ -0,0 +1,74 @@
+package imager
+
+// withEncodeDefaults fills in the configured defaults for the encoder settings
+// the request left unset.
+func (c Config) withEncodeDefaults(format ImageType, options Options) Options {
+	if options.Quality == 0 {
+		switch format {
+		case JPEG:
+			options.Quality = c.JPEGQuality
+		case PNG:
+			options.Quality = 100 // only used for palette quantisation
+		case WEBP:
+			options.Quality = c.WebPQuality
+		case AVIF:
+			options.Quality = c.AVIFQuality
+		}
+	}
+	if options.Compression == 0 {
+		options.Compression = c.PNGCompression
+	}
+	if format == JPEG && c.JPEGProgressive {
+		options.Progressive = true
+	}
+	return options
+}
+
+// lossy reports whether the encoder quality affects the output size.
+func lossy(format ImageType, options Options) bool {
+	switch format {
+	case JPEG, AVIF:
+		return true
+	case WEBP:
+		return !options.Lossless || options.NearLossless
+	case PNG:
+		return options.Palette
+	}
+	return false
+}
+
+// saveBudget binary searches the highest quality, up to options.Quality,
+// whose output of save fits in options.MaxBytes.
+func saveBudget(format ImageType, options Options, save func(Options) ([]byte, error)) ([]byte, int, error) {
+	buf, err := save(options)
+	if err != nil {
+		return nil, 0, &Error{Type: ENCODER_FAILURE, Err: err}
+	}
+	if len(buf) <= options.MaxBytes {
+		return buf, options.Quality, nil
+	}
+	if !lossy(format, options) {
+		return nil, 0, &Error{Type: LIMIT_EXCEEDED, Err: ErrByteBudgetExceeded}
+	}
+
+	var best []byte
+	bestQuality := 0
+	lo, hi := 1, options.Quality-1
+	for lo <= hi {
+		options.Quality = (lo + hi) / 2
+		buf, err = save(options)
+		if err != nil {
+			return nil, 0, &Error{Type: ENCODER_FAILURE, Err: err}
+		}
+		if len(buf) <= options.MaxBytes {
+			best, bestQuality = buf, options.Quality
+			lo = options.Quality + 1
+		} else {
+			hi = options.Quality - 1
+		}
+	}
+	if best == nil {
+		return nil, 0, &Error{Type: LIMIT_EXCEEDED, Err: ErrByteBudgetExceeded}
+	}
+	return best, bestQuality, nil
+}
@@ -0,0 +1,57 @@
+package imager
+
+import (
+	"context"
+	"errors"
+)
+
+type ErrorType int
+
+const (
+	UNSUPPORTED_FORMAT ErrorType = iota + 1
+	CORRUPT_INPUT
+	LIMIT_EXCEEDED
+	ENCODER_FAILURE
+	TIMEOUT
+	CANCELED
+	OVERLOADED
+	INVALID_OPTIONS
+)
+
+// Error is returned by Resize and Probe. Type classifies the cause, so callers
+// can tell bad input from server-side failures.
+type Error struct {
+	Type ErrorType
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrUnsupportedFormat is the cause of UNSUPPORTED_FORMAT errors, returned when
+// the linked libvips can't decode the input image.
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+
+// ErrByteBudgetExceeded is the cause of the LIMIT_EXCEEDED error returned when
+// the thumbnail doesn't fit in Options.MaxBytes even at the lowest quality.
+var ErrByteBudgetExceeded = errors.New("byte budget exceeded")
+
+// ErrEmptyRegion is the cause of the INVALID_OPTIONS error returned when
+// Options.Region lies outside of the image.
+var ErrEmptyRegion = errors.New("region outside of the image")
+
+// ErrQueueFull is the cause of OVERLOADED errors, returned when every worker
+// is busy and the queue is full.
+var ErrQueueFull = errors.New("resize queue full")
+
+func contextError(err error) error {
+	if err == context.DeadlineExceeded {
+		return &Error{Type: TIMEOUT, Err: err}
+	}
+	return &Error{Type: CANCELED, Err: err}
+}
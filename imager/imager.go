@@ -0,0 +1,355 @@
+package imager
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+)
+
+type ImageType int
+
+const (
+	UNKNOWN ImageType = iota
+	JPEG
+	PNG
+	WEBP
+	HEIF
+	AVIF
+	GIF
+)
+
+type GravityType int
+
+const (
+	CENTER GravityType = iota + 1
+	SMART
+	NORTH
+	NORTH_EAST
+	EAST
+	SOUTH_EAST
+	SOUTH
+	SOUTH_WEST
+	WEST
+	NORTH_WEST
+	FOCAL // Options.FocalX and FocalY
+)
+
+// Gravity maps the URL tokens to gravities. South is spelled out, s being
+// smart.
+var Gravity = map[string]GravityType{
+	"c":     CENTER,
+	"s":     SMART,
+	"n":     NORTH,
+	"ne":    NORTH_EAST,
+	"e":     EAST,
+	"se":    SOUTH_EAST,
+	"south": SOUTH,
+	"sw":    SOUTH_WEST,
+	"w":     WEST,
+	"nw":    NORTH_WEST,
+}
+
+type ResizeOpType int
+
+const (
+	CROP ResizeOpType = iota
+	FIT
+	FILL    // stretches to exactly Width x Height
+	SCALE   // Width and Height are percentages of the source's
+	INSIDE  // fits in Width x Height, keeping the aspect ratio
+	OUTSIDE // covers Width x Height, keeping the aspect ratio, without cropping
+)
+
+var ResizeOp = map[string]ResizeOpType{
+	"crop":    CROP,
+	"fit":     FIT,
+	"fill":    FILL,
+	"scale":   SCALE,
+	"inside":  INSIDE,
+	"outside": OUTSIDE,
+}
+
+type ColorModeType int
+
+const (
+	COLOR ColorModeType = iota
+	GRAY
+	BITONAL // black and white, thresholded at mid-gray
+)
+
+// Region is an area of an image, in pixels of the auto-rotated original.
+type Region struct {
+	X      int
+	Y      int
+	Width  int
+	Height int
+}
+
+func (r Region) Empty() bool {
+	return r.Width <= 0 || r.Height <= 0
+}
+
+// clip returns the part of r within a width x height image.
+func (r Region) clip(width int, height int) Region {
+	if r.X < 0 {
+		r.Width += r.X
+		r.X = 0
+	}
+	if r.Y < 0 {
+		r.Height += r.Y
+		r.Y = 0
+	}
+	if r.X+r.Width > width {
+		r.Width = width - r.X
+	}
+	if r.Y+r.Height > height {
+		r.Height = height - r.Y
+	}
+	return r
+}
+
+// anchoredCrop reports whether options crop at a compass gravity or a focal
+// point, rather than centered or smart crops.
+func anchoredCrop(options Options) bool {
+	return options.ResizeOp == CROP && options.Gravity != CENTER && options.Gravity != SMART
+}
+
+// resolveResizeOp returns options for a width x height source with the
+// SCALE, INSIDE and OUTSIDE operations turned into a FILL of the size they
+// resize it to, and the size of CROP and FILL limited to the source's if
+// NoEnlarge is set.
+func resolveResizeOp(options Options, width int, height int) Options {
+	switch options.ResizeOp {
+	case SCALE:
+		options.Width = max1(int(math.Round(float64(width*options.Width) / 100)))
+		options.Height = max1(int(math.Round(float64(height*options.Height) / 100)))
+		options.ResizeOp = FILL
+	case INSIDE:
+		options.Width, options.Height = containSize(width, height, options.Width, options.Height, options.NoEnlarge)
+		options.ResizeOp = FILL
+	case OUTSIDE:
+		if !options.NoEnlarge || width >= options.Width && height >= options.Height {
+			width, height = coverSize(width, height, options.Width, options.Height)
+		}
+		options.Width, options.Height = width, height
+		options.ResizeOp = FILL
+	case CROP, FILL:
+		if options.NoEnlarge {
+			options.Width = clamp(options.Width, 1, width)
+			options.Height = clamp(options.Height, 1, height)
+		}
+	}
+	return options
+}
+
+// containSize returns the largest size with the aspect ratio of a
+// width x height image fitting in boxWidth x boxHeight, or the image's own
+// size if it already fits and noEnlarge is set.
+func containSize(width int, height int, boxWidth int, boxHeight int, noEnlarge bool) (int, int) {
+	if noEnlarge && width <= boxWidth && height <= boxHeight {
+		return width, height
+	}
+	if width*boxHeight > boxWidth*height {
+		// aspect ratio of the image is bigger than the box's, shrink height
+		return boxWidth, max1(boxWidth * height / width)
+	}
+	return max1(width * boxHeight / height), boxHeight
+}
+
+// coverSize returns the smallest size with the aspect ratio of a
+// width x height image covering cropWidth x cropHeight.
+func coverSize(width int, height int, cropWidth int, cropHeight int) (int, int) {
+	if width*cropHeight > cropWidth*height {
+		return (width*cropHeight + height - 1) / height, cropHeight
+	}
+	return cropWidth, (height*cropWidth + width - 1) / width
+}
+
+// cropOffset returns the top left corner of a cropWidth x cropHeight crop of
+// a width x height image, placed at the gravity of options. Other gravities
+// are centered.
+func cropOffset(options Options, width int, height int, cropWidth int, cropHeight int) (int, int) {
+	maxX, maxY := width-cropWidth, height-cropHeight
+	x, y := maxX/2, maxY/2
+	switch options.Gravity {
+	case NORTH, NORTH_EAST, NORTH_WEST:
+		y = 0
+	case SOUTH, SOUTH_EAST, SOUTH_WEST:
+		y = maxY
+	case FOCAL:
+		x = clamp(int(math.Round(options.FocalX*float64(width)))-cropWidth/2, 0, maxX)
+		y = clamp(int(math.Round(options.FocalY*float64(height)))-cropHeight/2, 0, maxY)
+	}
+	switch options.Gravity {
+	case NORTH_WEST, WEST, SOUTH_WEST:
+		x = 0
+	case NORTH_EAST, EAST, SOUTH_EAST:
+		x = maxX
+	}
+	return x, y
+}
+
+func max1(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+func clamp(n int, min int, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
+
+// rotation normalizes a clockwise rotation in degrees to 0, 90, 180 or 270.
+// Other angles are rounded down to a multiple of 90.
+func rotation(degrees int) int {
+	degrees %= 360
+	if degrees < 0 {
+		degrees += 360
+	}
+	return degrees / 90 * 90
+}
+
+type MetadataPolicyType int
+
+const (
+	STRIP_ALL MetadataPolicyType = iota
+	KEEP_ICC
+	KEEP_COPYRIGHT
+	STRIP_GPS
+)
+
+var MetadataPolicy = map[string]MetadataPolicyType{
+	"strip":     STRIP_ALL,
+	"icc":       KEEP_ICC,
+	"copyright": KEEP_COPYRIGHT,
+	"nogps":     STRIP_GPS,
+}
+
+type Options struct {
+	Width            int
+	Height           int
+	ResizeOp         ResizeOpType
+	Gravity          GravityType
+	ExtendBackground []float64
+	Format           ImageType // output format, UNKNOWN picks one every client decodes, see saveType
+	FocalX           float64   // focal point of the FOCAL gravity, relative to the
+	FocalY           float64   // width and height of the source, 0-1
+	NoEnlarge        bool      // never resize beyond the source's size
+
+	// Source and output transformations
+	Region    Region // area cropped from the original before resizing, all of it when empty
+	Flip      bool   // mirror horizontally, before rotating
+	Rotate    int    // clockwise rotation in degrees, a multiple of 90, after resizing
+	ColorMode ColorModeType
+
+	// Encoder settings, zero values use the configured defaults
+	Quality      int  // 1-100
+	Progressive  bool // progressive JPEG, interlaced PNG
+	Compression  int  // PNG zlib compression level 1-9
+	Palette      bool // PNG palette quantisation
+	Lossless     bool // lossless WebP
+	NearLossless bool // near-lossless WebP, Quality sets the preprocessing level
+	MaxBytes     int  // byte budget, Quality is lowered until the output fits
+
+	WideGamut bool // convert to Display P3 instead of sRGB
+}
+
+// Imager resizes images. Vips is the default implementation; Native, which
+// doesn't need cgo, is built instead with the purego tag or when cgo is
+// disabled. Errors are of type *Error.
+type Imager interface {
+	// Resize returns the thumbnail of buf and the encoder quality it was
+	// saved with. It gives up when ctx is done.
+	Resize(ctx context.Context, buf []byte, options Options) ([]byte, int, error)
+	// Probe reads the header of buf and checks it against the configured
+	// limits, counting the pixels of the first frame of animations.
+	Probe(buf []byte) (Info, error)
+	// SupportedFormats returns the formats thumbnails can be encoded as.
+	SupportedFormats() []ImageType
+}
+
+func GetImageType(buf []byte) ImageType {
+	if len(buf) < 12 {
+		return UNKNOWN
+	}
+	if buf[0] == 0xFF && buf[1] == 0xD8 && buf[2] == 0xFF {
+		return JPEG
+	}
+	if buf[0] == 0x89 && buf[1] == 0x50 && buf[2] == 0x4E && buf[3] == 0x47 {
+		return PNG
+	}
+	if buf[0] == 0x52 && buf[1] == 0x49 && buf[2] == 0x46 && buf[3] == 0x46 &&
+		buf[8] == 0x57 && buf[9] == 0x45 && buf[10] == 0x42 && buf[11] == 0x50 {
+		return WEBP
+	}
+	if buf[0] == 0x47 && buf[1] == 0x49 && buf[2] == 0x46 && buf[3] == 0x38 {
+		return GIF
+	}
+	if buf[4] == 0x66 && buf[5] == 0x74 && buf[6] == 0x79 && buf[7] == 0x70 {
+		return getFtypImageType(buf)
+	}
+	return UNKNOWN
+}
+
+// getFtypImageType parses the ftyp box at the start of an ISO base media file
+// (box size, "ftyp", major brand, minor version, compatible brands) and
+// returns AVIF or HEIF if any of its brands match.
+func getFtypImageType(buf []byte) ImageType {
+	size := int(binary.BigEndian.Uint32(buf[0:4]))
+	if size > len(buf) {
+		size = len(buf)
+	}
+	brands := []string{string(buf[8:12])}
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, string(buf[i:i+4]))
+	}
+	imageType := UNKNOWN
+	for _, brand := range brands {
+		switch brand {
+		case "avif", "avis":
+			return AVIF
+		case "heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1":
+			imageType = HEIF
+		}
+	}
+	return imageType
+}
+
+// saveType returns the format the thumbnail of the original described by info
+// is encoded in without Options.Format, one every client decodes: JPEG and PNG
+// originals keep their format, GIFs and animated WebPs are encoded as GIF, and
+// other originals (WebP, AVIF, HEIF) as JPEG, or PNG when they have an alpha
+// channel. GIFs fall back to PNG, which keeps transparency, when libvips can't
+// save GIF.
+func saveType(info Info) ImageType {
+	switch {
+	case info.Type == JPEG || info.Type == PNG:
+		return info.Type
+	case info.Type == GIF || isAnimation(info.Type, info.Pages):
+		if savers[GIF] {
+			return GIF
+		}
+		return PNG
+	case info.Alpha:
+		return PNG
+	}
+	return JPEG
+}
+
+// supportedFormats returns the formats in savers, in a stable order.
+func supportedFormats() []ImageType {
+	var formats []ImageType
+	for _, format := range []ImageType{JPEG, PNG, WEBP, AVIF, GIF} {
+		if savers[format] {
+			formats = append(formats, format)
+		}
+	}
+	return formats
+}
@@ -0,0 +1,326 @@
+package imager
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"image"
+	_ "image/png"
+	"io/ioutil"
+	"math"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// update rewrites the golden images with the thumbnails of this build, e.g.
+// go test ./imager -run TestResize_Golden -update
+var update = flag.Bool("update", false, "rewrite the golden images in testdata")
+
+// testConfig has the defaults of the config package.
+var testConfig = Config{
+	JPEGQuality:            80,
+	PNGCompression:         6,
+	WebPQuality:            80,
+	AVIFQuality:            50,
+	MaxWidth:               20000,
+	MaxHeight:              20000,
+	MaxMegapixels:          200,
+	MaxPages:               1000,
+	AnimationEnable:        true,
+	AnimationMaxFrames:     100,
+	AnimationMaxMegapixels: 50,
+	ColorConvert:           true,
+	MetadataPolicy:         STRIP_ALL,
+	Timeout:                30 * time.Second,
+	QueueSize:              100,
+	VipsCacheMax:           100,
+	VipsCacheMaxMem:        100 * 1024 * 1024,
+	VipsCacheMaxFiles:      100,
+}
+
+func TestGetImageType(t *testing.T) {
+	tests := []struct {
+		filename  string
+		imageType ImageType
+	}{
+		{"natasha-kasim-708827-unsplash.jpg", JPEG},
+		{"1x1-lossy.webp", WEBP},
+		{"1x1-lossless.webp", WEBP},
+		{"1x1-alpha.webp", WEBP},
+		{"animated.gif", GIF},
+	}
+	for _, test := range tests {
+		buf, err := ioutil.ReadFile("../testdata/" + test.filename)
+		if err != nil {
+			t.Errorf("Could not read test file %s", test.filename)
+			continue
+		}
+		if imageType := GetImageType(buf); imageType != test.imageType {
+			t.Errorf("%s: expected image type %d, got %d", test.filename, test.imageType, imageType)
+		}
+	}
+	if GetImageType([]byte("RIFF\x00\x00\x00\x00WAVE")) != UNKNOWN {
+		t.Errorf("RIFF container without WEBP fourcc detected as known type")
+	}
+}
+
+func TestGetImageType_Ftyp(t *testing.T) {
+	tests := []struct {
+		ftyp      string
+		imageType ImageType
+	}{
+		{"\x00\x00\x00\x18ftypheic\x00\x00\x00\x00mif1heic", HEIF},
+		{"\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00mif1heic", HEIF},
+		{"\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf", AVIF},
+		{"\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00mif1avif", AVIF},
+		{"\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2", UNKNOWN},
+		// brands past the declared box size are ignored
+		{"\x00\x00\x00\x10ftypisom\x00\x00\x02\x00heic", UNKNOWN},
+	}
+	for _, test := range tests {
+		if imageType := GetImageType([]byte(test.ftyp)); imageType != test.imageType {
+			t.Errorf("%q: expected image type %d, got %d", test.ftyp, test.imageType, imageType)
+		}
+	}
+}
+
+func TestSaveType(t *testing.T) {
+	gif := PNG
+	if savers[GIF] {
+		gif = GIF
+	}
+	tests := []struct {
+		info     Info
+		expected ImageType
+	}{
+		{Info{Type: JPEG}, JPEG},
+		{Info{Type: PNG, Alpha: true}, PNG},
+		{Info{Type: HEIF}, JPEG},
+		{Info{Type: AVIF}, JPEG},
+		{Info{Type: AVIF, Alpha: true}, PNG},
+		{Info{Type: WEBP, Pages: 1}, JPEG},
+		{Info{Type: WEBP, Pages: 1, Alpha: true}, PNG},
+		{Info{Type: WEBP, Pages: 10}, gif},
+		{Info{Type: GIF, Pages: 1}, gif},
+	}
+	for _, test := range tests {
+		if format := saveType(test.info); format != test.expected {
+			t.Errorf("%+v: expected format %d, got %d", test.info, test.expected, format)
+		}
+	}
+}
+
+func TestExceededLimit(t *testing.T) {
+	config := Config{MaxWidth: 10000, MaxMegapixels: 20, MaxPages: 30}
+	tests := []struct {
+		info   Info
+		frames int
+		limit  string
+	}{
+		{Info{Width: 5000, Height: 4000, Pages: 1}, 1, ""},
+		{Info{Width: 5000, Height: 4001, Pages: 1}, 1, "megapixels"},
+		{Info{Width: 6997, Height: 3000, Pages: 1}, 1, "megapixels"}, // 20.99 megapixels
+		{Info{Width: 1000, Height: 1000, Pages: 21}, 21, "megapixels"},
+		// only the first frame of a still thumbnail is decoded
+		{Info{Width: 1000, Height: 1000, Pages: 21}, 1, ""},
+		{Info{Width: 10001, Height: 1, Pages: 1}, 1, "width"},
+		{Info{Width: 1, Height: 1, Pages: 31}, 1, "pages"},
+	}
+	for _, test := range tests {
+		err := config.exceededLimit(test.info, test.frames)
+		if test.limit == "" && err != nil || test.limit != "" && (err == nil || err.Limit != test.limit) {
+			t.Errorf("%+v, %d frames: expected limit %q, got %v", test.info, test.frames, test.limit, err)
+		}
+	}
+}
+
+func TestRotation(t *testing.T) {
+	for degrees, expected := range map[int]int{0: 0, 90: 90, 450: 90, -90: 270, 45: 0, 359: 270} {
+		if angle := rotation(degrees); angle != expected {
+			t.Errorf("%d: expected %d, got %d", degrees, expected, angle)
+		}
+	}
+}
+
+func TestCoverSize(t *testing.T) {
+	tests := []struct {
+		width, height, cropWidth, cropHeight int
+		coverWidth, coverHeight              int
+	}{
+		{2400, 1600, 100, 100, 150, 100},
+		{1600, 2400, 100, 100, 100, 150},
+		{1000, 3, 10, 10, 3334, 10},
+		{100, 50, 200, 100, 200, 100},
+	}
+	for _, test := range tests {
+		width, height := coverSize(test.width, test.height, test.cropWidth, test.cropHeight)
+		if width != test.coverWidth || height != test.coverHeight {
+			t.Errorf("%dx%d covering %dx%d: expected %dx%d, got %dx%d",
+				test.width, test.height, test.cropWidth, test.cropHeight,
+				test.coverWidth, test.coverHeight, width, height)
+		}
+	}
+}
+
+func TestResolveResizeOp(t *testing.T) {
+	tests := []struct {
+		options       Options
+		width, height int
+	}{
+		{Options{Width: 25, Height: 50, ResizeOp: SCALE}, 100, 100},
+		{Options{Width: 1, Height: 1, ResizeOp: SCALE}, 4, 2},
+		{Options{Width: 100, Height: 100, ResizeOp: INSIDE}, 100, 50},
+		{Options{Width: 1000, Height: 1000, ResizeOp: INSIDE}, 1000, 500},
+		{Options{Width: 1000, Height: 1000, ResizeOp: INSIDE, NoEnlarge: true}, 400, 200},
+		{Options{Width: 100, Height: 100, ResizeOp: OUTSIDE}, 200, 100},
+		{Options{Width: 100, Height: 300, ResizeOp: OUTSIDE, NoEnlarge: true}, 400, 200},
+		{Options{Width: 1000, Height: 100, ResizeOp: FILL, NoEnlarge: true}, 400, 100},
+		{Options{Width: 1000, Height: 1000, ResizeOp: CROP, NoEnlarge: true}, 400, 200},
+		{Options{Width: 1000, Height: 1000, ResizeOp: FIT, NoEnlarge: true}, 1000, 1000},
+	}
+	for _, test := range tests {
+		options := resolveResizeOp(test.options, 400, 200)
+		if options.Width != test.width || options.Height != test.height {
+			t.Errorf("%+v: expected %dx%d, got %dx%d",
+				test.options, test.width, test.height, options.Width, options.Height)
+		}
+		if op := test.options.ResizeOp; op != FIT && op != CROP && options.ResizeOp != FILL {
+			t.Errorf("%+v: expected FILL, got %d", test.options, options.ResizeOp)
+		}
+	}
+}
+
+func TestContainSize(t *testing.T) {
+	tests := []struct {
+		width, height, boxWidth, boxHeight int
+		noEnlarge                          bool
+		containWidth, containHeight        int
+	}{
+		{2400, 1600, 100, 100, false, 100, 66},
+		{1600, 2400, 100, 100, false, 66, 100},
+		{100, 50, 400, 400, false, 400, 200},
+		{100, 50, 400, 400, true, 100, 50},
+		{100, 50, 50, 400, true, 50, 25},
+		{1000, 1, 10, 10, false, 10, 1},
+	}
+	for _, test := range tests {
+		width, height := containSize(test.width, test.height, test.boxWidth, test.boxHeight, test.noEnlarge)
+		if width != test.containWidth || height != test.containHeight {
+			t.Errorf("%dx%d in %dx%d: expected %dx%d, got %dx%d",
+				test.width, test.height, test.boxWidth, test.boxHeight,
+				test.containWidth, test.containHeight, width, height)
+		}
+	}
+}
+
+func TestCropOffset(t *testing.T) {
+	tests := []struct {
+		options               Options
+		cropWidth, cropHeight int
+		x, y                  int
+	}{
+		{Options{Gravity: CENTER}, 50, 50, 25, 0},
+		{Options{Gravity: SMART}, 50, 50, 25, 0},
+		{Options{Gravity: NORTH_WEST}, 50, 50, 0, 0},
+		{Options{Gravity: EAST}, 50, 50, 50, 0},
+		{Options{Gravity: SOUTH}, 100, 20, 0, 30},
+		{Options{Gravity: NORTH_EAST}, 100, 20, 0, 0},
+		{Options{Gravity: FOCAL, FocalX: 0.3, FocalY: 0.5}, 50, 50, 5, 0},
+		{Options{Gravity: FOCAL, FocalX: 0.9, FocalY: 0.9}, 50, 20, 50, 30},
+	}
+	for _, test := range tests {
+		// of a 100x50 image
+		x, y := cropOffset(test.options, 100, 50, test.cropWidth, test.cropHeight)
+		if x != test.x || y != test.y {
+			t.Errorf("%+v, %dx%d: expected %d,%d, got %d,%d",
+				test.options, test.cropWidth, test.cropHeight, test.x, test.y, x, y)
+		}
+	}
+}
+
+// TestResize_Golden compares a thumbnail per resize operation with the golden
+// image stored at its thumbnail path in testdata. Vips and Native resample
+// differently, so pixels only need to be close.
+func TestResize_Golden(t *testing.T) {
+	const original = "samuel-clara-69657-unsplash.jpg" // 2400x1600
+	buf, err := ioutil.ReadFile("../testdata/" + original)
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	tests := []struct {
+		resizeTier string
+		options    Options
+	}{
+		{"60x60/crop/c", Options{Width: 60, Height: 60, ResizeOp: CROP, Gravity: CENTER}},
+		{"60x60/fit/0", Options{Width: 60, Height: 60, ResizeOp: FIT}},
+		{"60x60/fit/ffffff", Options{Width: 60, Height: 60, ResizeOp: FIT, ExtendBackground: []float64{255, 255, 255}}},
+		{"60x60/fill/0", Options{Width: 60, Height: 60, ResizeOp: FILL}},
+		{"5x5/scale/0", Options{Width: 5, Height: 5, ResizeOp: SCALE}},
+		{"60x60/inside/0", Options{Width: 60, Height: 60, ResizeOp: INSIDE}},
+		{"60x60/outside/0", Options{Width: 60, Height: 60, ResizeOp: OUTSIDE}},
+		{"100x100/fill/0,rect1000:600:40:30,noenlarge", Options{Width: 100, Height: 100, ResizeOp: FILL,
+			Region: Region{X: 1000, Y: 600, Width: 40, Height: 30}, NoEnlarge: true}},
+	}
+	n := New(testConfig)
+	for _, test := range tests {
+		test.options.Format = PNG
+		thumbBuf, _, err := n.Resize(context.Background(), buf, test.options)
+		if err != nil {
+			t.Errorf("%s: resize failed: %v", test.resizeTier, err)
+			continue
+		}
+		golden := path.Join("../testdata", test.resizeTier, original+".png")
+		if *update {
+			os.MkdirAll(path.Dir(golden), 0755)
+			if err := ioutil.WriteFile(golden, thumbBuf, 0644); err != nil {
+				t.Fatalf("Could not write %s", golden)
+			}
+			continue
+		}
+		goldenBuf, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Errorf("%s: could not read golden image", test.resizeTier)
+			continue
+		}
+		if diff, err := meanDifference(thumbBuf, goldenBuf); err != nil || diff > 8 {
+			t.Errorf("%s: differs from the golden image by %.1f (%v)", test.resizeTier, diff, err)
+		}
+	}
+}
+
+// meanDifference returns the mean absolute difference of the RGB channels of
+// two images of the same size, 0-255.
+func meanDifference(buf []byte, goldenBuf []byte) (float64, error) {
+	img, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return 0, err
+	}
+	golden, _, err := image.Decode(bytes.NewReader(goldenBuf))
+	if err != nil {
+		return 0, err
+	}
+	bounds := img.Bounds()
+	if bounds.Size() != golden.Bounds().Size() {
+		return 0, fmt.Errorf("expected %v, got %v", golden.Bounds().Size(), bounds.Size())
+	}
+	var sum, count float64
+	offset := golden.Bounds().Min.Sub(bounds.Min)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			r1, g1, b1, _ := img.At(x, y).RGBA()
+			r2, g2, b2, _ := golden.At(x+offset.X, y+offset.Y).RGBA()
+			for _, d := range []float64{
+				float64(r1) - float64(r2),
+				float64(g1) - float64(g2),
+				float64(b1) - float64(b2),
+			} {
+				sum += math.Abs(d) / 257
+				count++
+			}
+		}
+	}
+	return sum / count, nil
+}
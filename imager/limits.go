@@ -0,0 +1,53 @@
+package imager
+
+import "fmt"
+
+// Info describes an image as read from its header.
+type Info struct {
+	Type   ImageType
+	Width  int // after EXIF orientation
+	Height int
+	Pages  int // frames of an animation
+	Alpha  bool
+}
+
+// LimitError is the cause of the LIMIT_EXCEEDED errors returned for images
+// whose header exceeds the configured limits, before any pixels are decoded.
+type LimitError struct {
+	Limit string // width, height, megapixels or pages
+	Value int64
+	Max   int64
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("image %s %d exceeds limit %d", e.Limit, e.Value, e.Max)
+}
+
+// checkLimits checks info against the configured limits, with frames the
+// number of pages that will be decoded: 1 unless it's resized as an animation.
+func (c Config) checkLimits(info Info, frames int) error {
+	err := c.exceededLimit(info, frames)
+	if err != nil {
+		return &Error{Type: LIMIT_EXCEEDED, Err: err}
+	}
+	return nil
+}
+
+func (c Config) exceededLimit(info Info, frames int) *LimitError {
+	if max := int64(c.MaxWidth); max > 0 && int64(info.Width) > max {
+		return &LimitError{Limit: "width", Value: int64(info.Width), Max: max}
+	}
+	if max := int64(c.MaxHeight); max > 0 && int64(info.Height) > max {
+		return &LimitError{Limit: "height", Value: int64(info.Height), Max: max}
+	}
+	if max := int64(c.MaxPages); max > 0 && int64(info.Pages) > max {
+		return &LimitError{Limit: "pages", Value: int64(info.Pages), Max: max}
+	}
+	pixels := int64(info.Width) * int64(info.Height) * int64(frames)
+	if max := int64(c.MaxMegapixels); max > 0 && pixels > max*1000000 {
+		// rounded up, so the reported value exceeds the limit
+		megapixels := (pixels + 999999) / 1000000
+		return &LimitError{Limit: "megapixels", Value: megapixels, Max: max}
+	}
+	return nil
+}
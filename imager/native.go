@@ -0,0 +1,258 @@
+//go:build purego || !cgo
+// +build purego !cgo
+
+package imager
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// loaders and savers hold the formats the standard library and
+// golang.org/x/image can decode and encode.
+var (
+	loaders = map[ImageType]bool{JPEG: true, PNG: true, WEBP: true, GIF: true}
+	savers  = map[ImageType]bool{JPEG: true, PNG: true}
+)
+
+// Native is the pure-Go Imager, so the HTTP layer can be built and tested
+// without cgo. It's much slower than Vips and resizes in the caller's
+// goroutine. Smart crops fall back to centered ones, only the first frame of
+// animations is kept, and EXIF orientation, ICC profiles, progressive JPEG and
+// PNG palettes are ignored.
+type Native struct {
+	config Config
+}
+
+// New returns the Imager of this build.
+func New(config Config) Imager {
+	return &Native{config: config}
+}
+
+func (n *Native) Resize(ctx context.Context, buf []byte, options Options) ([]byte, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, contextError(err)
+	}
+	info, err := n.Probe(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if !options.Region.Empty() {
+		options.Region = options.Region.clip(info.Width, info.Height)
+		if options.Region.Empty() {
+			return nil, 0, &Error{Type: INVALID_OPTIONS, Err: ErrEmptyRegion}
+		}
+	}
+
+	format := options.Format
+	if !savers[format] {
+		format = saveType(info)
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(buf))
+	if err != nil {
+		return nil, 0, &Error{Type: CORRUPT_INPUT, Err: err}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, 0, contextError(err)
+	}
+	thumb := nativeThumbnail(src, options)
+	thumb = nativeOrient(thumb, rotation(options.Rotate), options.Flip)
+	thumb = nativeColorMode(thumb, options.ColorMode)
+
+	options = n.config.withEncodeDefaults(format, options)
+	options.Palette = false // the quality wouldn't change the PNG size
+	if options.MaxBytes > 0 {
+		return saveBudget(format, options, func(options Options) ([]byte, error) {
+			return nativeSave(format, thumb, options)
+		})
+	}
+	thumbBuf, err := nativeSave(format, thumb, options)
+	if err != nil {
+		return nil, 0, &Error{Type: ENCODER_FAILURE, Err: err}
+	}
+	return thumbBuf, options.Quality, nil
+}
+
+// Probe decodes the image config of buf, without decoding pixels, and checks
+// it against the configured limits.
+func (n *Native) Probe(buf []byte) (Info, error) {
+	imageType := GetImageType(buf)
+	if !loaders[imageType] {
+		return Info{}, &Error{Type: UNSUPPORTED_FORMAT, Err: ErrUnsupportedFormat}
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(buf))
+	if err != nil {
+		return Info{}, &Error{Type: CORRUPT_INPUT, Err: err}
+	}
+	info := Info{
+		Type:   imageType,
+		Width:  cfg.Width,
+		Height: cfg.Height,
+		Pages:  1,
+		Alpha:  hasAlpha(cfg.ColorModel),
+	}
+	return info, n.config.checkLimits(info, 1)
+}
+
+// hasAlpha reports whether images of model may have transparent pixels.
+func hasAlpha(model color.Model) bool {
+	switch model {
+	case color.RGBAModel, color.RGBA64Model, color.NRGBAModel, color.NRGBA64Model,
+		color.NYCbCrAModel, color.AlphaModel, color.Alpha16Model:
+		return true
+	}
+	// palettes may have transparent entries
+	_, paletted := model.(color.Palette)
+	return paletted
+}
+
+func (n *Native) SupportedFormats() []ImageType {
+	return supportedFormats()
+}
+
+// Shutdown releases the resources of the Imager, Native has none.
+func Shutdown() {}
+
+func nativeThumbnail(src image.Image, options Options) image.Image {
+	bounds := src.Bounds()
+	if region := options.Region; !region.Empty() {
+		bounds = image.Rect(region.X, region.Y, region.X+region.Width, region.Y+region.Height).
+			Add(bounds.Min)
+	}
+	iWidth, iHeight := bounds.Dx(), bounds.Dy()
+	options = resolveResizeOp(options, iWidth, iHeight)
+	width, height := options.Width, options.Height
+
+	switch options.ResizeOp {
+	case FIT:
+		width, height = containSize(iWidth, iHeight, width, height, options.NoEnlarge)
+	case CROP:
+		cropWidth, cropHeight := iWidth, iHeight
+		if iWidth*height > width*iHeight {
+			cropWidth = iHeight * width / height
+		} else {
+			cropHeight = iWidth * height / width
+		}
+		x, y := cropOffset(options, iWidth, iHeight, cropWidth, cropHeight)
+		bounds = image.Rect(0, 0, cropWidth, cropHeight).Add(bounds.Min).Add(image.Pt(x, y))
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(thumb, thumb.Bounds(), src, bounds, draw.Src, nil)
+
+	if len(options.ExtendBackground) == 0 || options.ResizeOp != FIT {
+		return thumb
+	}
+	bg := options.ExtendBackground
+	canvas := image.NewRGBA(image.Rect(0, 0, options.Width, options.Height))
+	draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.RGBA{
+		R: uint8(bg[0]),
+		G: uint8(bg[1]),
+		B: uint8(bg[2]),
+		A: 0xFF,
+	}), image.ZP, draw.Src)
+	x := (options.Width - width) / 2
+	y := (options.Height - height) / 2
+	draw.Draw(canvas, image.Rect(x, y, x+width, y+height), thumb, image.ZP, draw.Src)
+	return canvas
+}
+
+func nativeSave(imageType ImageType, img image.Image, options Options) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	switch imageType {
+	case JPEG:
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: options.Quality})
+	case PNG:
+		encoder := png.Encoder{CompressionLevel: pngCompressionLevel(options.Compression)}
+		err = encoder.Encode(&buf, img)
+	default:
+		err = ErrUnsupportedFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// nativeOrient mirrors img horizontally, if flip is set, then rotates it
+// clockwise by angle, one of 0, 90, 180 or 270.
+func nativeOrient(img image.Image, angle int, flip bool) image.Image {
+	if angle == 0 && !flip {
+		return img
+	}
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	oriented := image.NewRGBA(image.Rect(0, 0, width, height))
+	if angle == 90 || angle == 270 {
+		oriented = image.NewRGBA(image.Rect(0, 0, height, width))
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			srcX := x
+			if flip {
+				srcX = width - 1 - x
+			}
+			c := img.At(bounds.Min.X+srcX, bounds.Min.Y+y)
+			switch angle {
+			case 0:
+				oriented.Set(x, y, c)
+			case 90:
+				oriented.Set(height-1-y, x, c)
+			case 180:
+				oriented.Set(width-1-x, height-1-y, c)
+			case 270:
+				oriented.Set(y, width-1-x, c)
+			}
+		}
+	}
+	return oriented
+}
+
+// nativeColorMode converts img to grayscale, or to black and white, unless
+// mode is COLOR.
+func nativeColorMode(img image.Image, mode ColorModeType) image.Image {
+	if mode == COLOR {
+		return img
+	}
+	gray := image.NewGray(img.Bounds())
+	draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+	if mode == BITONAL {
+		for i, v := range gray.Pix {
+			if v >= 0x80 {
+				gray.Pix[i] = 0xFF
+			} else {
+				gray.Pix[i] = 0
+			}
+		}
+	}
+	return gray
+}
+
+// pngCompressionLevel maps zlib compression levels to the few image/png has.
+func pngCompressionLevel(compression int) png.CompressionLevel {
+	switch {
+	case compression <= 0:
+		return png.NoCompression
+	case compression <= 3:
+		return png.BestSpeed
+	case compression <= 6:
+		return png.DefaultCompression
+	}
+	return png.BestCompression
+}
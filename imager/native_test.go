@@ -0,0 +1,198 @@
+//go:build purego || !cgo
+// +build purego !cgo
+
+package imager
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"testing"
+)
+
+func TestNative_Resize(t *testing.T) {
+	// 2400x1600
+	buf, err := ioutil.ReadFile("../testdata/samuel-clara-69657-unsplash.jpg")
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	tests := []struct {
+		options Options
+		width   int
+		height  int
+	}{
+		{Options{Width: 100, Height: 100, ResizeOp: CROP, Gravity: CENTER}, 100, 100},
+		{Options{Width: 100, Height: 100, ResizeOp: FIT}, 100, 66},
+		{Options{Width: 100, Height: 100, ResizeOp: FIT, ExtendBackground: []float64{255, 0, 0}}, 100, 100},
+		{Options{Width: 60, Height: 100, ResizeOp: CROP, Gravity: SMART, Format: PNG}, 60, 100},
+		{Options{Width: 50, Height: 80, ResizeOp: FILL}, 50, 80},
+		// clipped to 400x400
+		{Options{Width: 100, Height: 100, ResizeOp: FIT, Region: Region{X: 2000, Y: 1200, Width: 800, Height: 800}}, 100, 100},
+		{Options{Width: 90, Height: 60, ResizeOp: FILL, Rotate: 90, Flip: true, ColorMode: GRAY}, 60, 90},
+		{Options{Width: 100, Height: 100, ResizeOp: CROP, Gravity: NORTH_EAST}, 100, 100},
+		{Options{Width: 40, Height: 100, ResizeOp: CROP, Gravity: FOCAL, FocalX: 1, FocalY: 0,
+			Region: Region{X: 100, Y: 100, Width: 1000, Height: 500}}, 40, 100},
+	}
+	n := New(testConfig)
+	for _, test := range tests {
+		thumbBuf, _, err := n.Resize(context.Background(), buf, test.options)
+		if err != nil {
+			t.Errorf("%+v: resize failed: %v", test.options, err)
+			continue
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(thumbBuf))
+		if err != nil {
+			t.Errorf("%+v: could not decode thumbnail: %v", test.options, err)
+			continue
+		}
+		if cfg.Width != test.width || cfg.Height != test.height {
+			t.Errorf("%+v: expected %dx%d, got %dx%d",
+				test.options, test.width, test.height, cfg.Width, cfg.Height)
+		}
+		format := test.options.Format
+		if format == UNKNOWN {
+			format = JPEG
+		}
+		if GetImageType(thumbBuf) != format {
+			t.Errorf("%+v: expected image type %d", test.options, format)
+		}
+	}
+}
+
+func TestNative_MaxBytes(t *testing.T) {
+	buf, err := ioutil.ReadFile("../testdata/samuel-clara-69657-unsplash.jpg")
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	n := New(testConfig)
+	options := Options{Width: 480, Height: 640, ResizeOp: CROP, Gravity: CENTER, Quality: 95}
+	fullBuf, _, err := n.Resize(context.Background(), buf, options)
+	if err != nil {
+		t.Fatalf("resize failed: %v", err)
+	}
+	options.MaxBytes = len(fullBuf) / 2
+	thumbBuf, quality, err := n.Resize(context.Background(), buf, options)
+	if err != nil || len(thumbBuf) > options.MaxBytes || quality >= 95 {
+		t.Errorf("expected a thumbnail within %d bytes, got %d bytes at quality %d (%v)",
+			options.MaxBytes, len(thumbBuf), quality, err)
+	}
+}
+
+func TestNative_Errors(t *testing.T) {
+	n := New(testConfig)
+	options := Options{Width: 100, Height: 100, ResizeOp: CROP, Gravity: CENTER}
+	tests := []struct {
+		name      string
+		buf       []byte
+		errorType ErrorType
+	}{
+		{"unknown format", []byte("this is not an image"), UNSUPPORTED_FORMAT},
+		{"broken header", append([]byte{0xFF, 0xD8, 0xFF}, make([]byte, 100)...), CORRUPT_INPUT},
+	}
+	for _, test := range tests {
+		_, _, err := n.Resize(context.Background(), test.buf, options)
+		if imagerErr, ok := err.(*Error); !ok || imagerErr.Type != test.errorType {
+			t.Errorf("%s: expected error type %d, got %v", test.name, test.errorType, err)
+		}
+	}
+
+	buf, err := ioutil.ReadFile("../testdata/samuel-clara-69657-unsplash.jpg")
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	outside := options
+	outside.Region = Region{X: 2400, Y: 0, Width: 100, Height: 100}
+	_, _, err = n.Resize(context.Background(), buf, outside)
+	if imagerErr, ok := err.(*Error); !ok || imagerErr.Type != INVALID_OPTIONS || imagerErr.Err != ErrEmptyRegion {
+		t.Errorf("expected an INVALID_OPTIONS ErrEmptyRegion, got %v", err)
+	}
+
+	buf, err = ioutil.ReadFile("../testdata/50000x50000.png")
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	if _, err := n.Probe(buf); err == nil {
+		t.Errorf("expected LIMIT_EXCEEDED error")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = n.Resize(ctx, buf, options)
+	if imagerErr, ok := err.(*Error); !ok || imagerErr.Type != CANCELED {
+		t.Errorf("expected CANCELED error, got %v", err)
+	}
+}
+
+func TestNativeOrient(t *testing.T) {
+	// 2x1, red then blue
+	red, blue := color.RGBA{R: 0xFF, A: 0xFF}, color.RGBA{B: 0xFF, A: 0xFF}
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, red)
+	img.Set(1, 0, blue)
+
+	tests := []struct {
+		angle  int
+		flip   bool
+		bounds image.Rectangle
+		red    image.Point
+	}{
+		{0, true, image.Rect(0, 0, 2, 1), image.Pt(1, 0)},
+		{90, false, image.Rect(0, 0, 1, 2), image.Pt(0, 0)},
+		{180, false, image.Rect(0, 0, 2, 1), image.Pt(1, 0)},
+		{270, false, image.Rect(0, 0, 1, 2), image.Pt(0, 1)},
+		{90, true, image.Rect(0, 0, 1, 2), image.Pt(0, 1)},
+	}
+	for _, test := range tests {
+		oriented := nativeOrient(img, test.angle, test.flip)
+		if oriented.Bounds() != test.bounds {
+			t.Errorf("%d, flip %t: expected bounds %v, got %v", test.angle, test.flip, test.bounds, oriented.Bounds())
+			continue
+		}
+		if oriented.At(test.red.X, test.red.Y) != color.Color(red) {
+			t.Errorf("%d, flip %t: expected red at %v", test.angle, test.flip, test.red)
+		}
+	}
+}
+
+func TestNativeColorMode(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.RGBA{R: 0x60, G: 0x60, B: 0x60, A: 0xFF})
+	img.Set(1, 0, color.RGBA{R: 0xA0, G: 0xA0, B: 0xA0, A: 0xFF})
+
+	gray, ok := nativeColorMode(img, GRAY).(*image.Gray)
+	if !ok || gray.Pix[0] != 0x60 || gray.Pix[1] != 0xA0 {
+		t.Errorf("expected gray pixels, got %v", gray)
+	}
+	bitonal, ok := nativeColorMode(img, BITONAL).(*image.Gray)
+	if !ok || bitonal.Pix[0] != 0 || bitonal.Pix[1] != 0xFF {
+		t.Errorf("expected black and white pixels, got %v", bitonal)
+	}
+}
+
+func TestNative_SaveType(t *testing.T) {
+	n := New(Config{JPEGQuality: 80, PNGCompression: 6})
+	tests := []struct {
+		filename string
+		expected ImageType
+	}{
+		{"1x1-lossy.webp", JPEG},
+		{"1x1-alpha.webp", PNG},
+	}
+	for _, test := range tests {
+		buf, err := ioutil.ReadFile("../testdata/" + test.filename)
+		if err != nil {
+			t.Errorf("Could not read test file %s", test.filename)
+			continue
+		}
+		thumbBuf, _, err := n.Resize(context.Background(), buf, Options{Width: 1, Height: 1, ResizeOp: FILL})
+		if err != nil {
+			t.Errorf("%s: resize failed: %v", test.filename, err)
+			continue
+		}
+		if format := GetImageType(thumbBuf); format != test.expected {
+			t.Errorf("%s: expected format %d, got %d", test.filename, test.expected, format)
+		}
+	}
+}
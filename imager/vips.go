@@ -1,70 +1,53 @@
+//go:build cgo && !purego
+// +build cgo,!purego
+
 package imager
 
 /*
 #cgo pkg-config: vips
+#include <stdlib.h>
 #include "vips.h"
 */
 import "C"
 import (
+	"context"
 	"errors"
 	"log"
 	"runtime"
+	"sync"
+	"time"
 	"unsafe"
-)
-
-type ImageType int
 
-const (
-	UNKNOWN ImageType = iota
-	JPEG
-	PNG
+	"github.com/rcrowley/go-metrics"
 )
 
-type GravityType int
-
-const (
-	CENTER GravityType = iota + 1
-	SMART
-)
-
-var Gravity = map[string]GravityType{
-	"c": CENTER,
-	"s": SMART,
-}
-
-type ResizeOpType int
-
-const (
-	CROP ResizeOpType = iota
-	FIT
-)
-
-var ResizeOp = map[string]ResizeOpType{
-	"crop": CROP,
-	"fit":  FIT,
-}
-
-type Options struct {
-	Width            int
-	Height           int
-	ResizeOp         ResizeOpType
-	Gravity          GravityType
-	Quality          int
-	ExtendBackground []float64
-}
-
 type ResizeRequest struct {
-	in      []byte
-	options Options
-	out     chan *ResizeResponse
+	ctx      context.Context
+	vips     *Vips
+	in       []byte
+	options  Options
+	out      chan *ResizeResponse
+	queuedAt time.Time
 }
 
 type ResizeResponse struct {
-	buf []byte
-	err error
+	buf     []byte
+	quality int
+	err     error
 }
 
-var reqChan chan *ResizeRequest
+var (
+	reqChan   chan *ResizeRequest
+	startOnce sync.Once
+)
+
+// loaders and savers hold the formats the linked libvips can decode and
+// encode. HEIF and AVIF are only available when libvips was built with libheif,
+// AVIF output when an AVIF can actually be encoded.
+var (
+	loaders = map[ImageType]bool{JPEG: true, PNG: true, WEBP: true}
+	savers  = map[ImageType]bool{JPEG: true, PNG: true, WEBP: true}
+)
 
 func init() {
 	runtime.LockOSThread()
@@ -76,8 +59,43 @@ func init() {
 		log.Fatalf("vips_init failed\n")
 	}
 
-	reqChan = make(chan *ResizeRequest, 100)
-	for w := 0; w < runtime.NumCPU(); w++ {
+	if vipsOperationExists("heifload_buffer") {
+		loaders[HEIF] = true
+		loaders[AVIF] = true
+	} else {
+		log.Println("libvips was built without libheif, HEIF and AVIF input disabled")
+	}
+	if vipsOperationExists("heifsave_buffer") && C.vips_can_save_cgo(C.int(AVIF)) != 0 {
+		savers[AVIF] = true
+	} else {
+		log.Println("libvips can't encode AV1, AVIF output disabled")
+	}
+	if vipsOperationExists("gifload_buffer") {
+		loaders[GIF] = true
+	}
+	if vipsOperationExists("gifsave_buffer") {
+		savers[GIF] = true
+	}
+}
+
+// start applies the libvips settings of config and starts the worker pool. It
+// runs on the first resize rather than in init, once the config is known.
+func start(config Config) {
+	C.vips_concurrency_set(C.int(config.VipsConcurrency))
+	C.vips_cache_set_max(C.int(config.VipsCacheMax))
+	C.vips_cache_set_max_mem(C.size_t(config.VipsCacheMaxMem))
+	C.vips_cache_set_max_files(C.int(config.VipsCacheMaxFiles))
+
+	workers := config.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	reqChan = make(chan *ResizeRequest, config.QueueSize)
+	metrics.GetOrRegisterGauge("imager.workers", nil).Update(int64(workers))
+	metrics.NewRegisteredFunctionalGauge("imager.queue.length", nil, func() int64 {
+		return int64(len(reqChan))
+	})
+	for w := 0; w < workers; w++ {
 		go worker(reqChan)
 	}
 }
@@ -87,77 +105,240 @@ func worker(reqChan <-chan *ResizeRequest) {
 	defer runtime.UnlockOSThread()
 	defer C.vips_thread_shutdown()
 
+	queueWait := metrics.GetOrRegisterTimer("imager.queue.wait", nil)
 	for req := range reqChan {
-		buf := req.in
-		options := req.options
-
-		var iWidth, iHeight, origOWidth, origOHeight int
-		if options.ResizeOp == FIT {
-			image, err := vipsImageNew(buf) // this is efficient because vips only reads bytes as needed
-			if err != nil {
-				req.out <- &ResizeResponse{buf: nil, err: err}
-			}
-			iWidth = int(C.vips_image_get_width(image))
-			iHeight = int(C.vips_image_get_height(image))
-			origOWidth = options.Width
-			origOHeight = options.Height
-			if iWidth*options.Height > options.Width*iHeight {
-				// aspect ratio of original image is bigger than target aspect ratio
-				// shrink height
-				options.Height = options.Width * iHeight / iWidth
-			} else {
-				options.Width = iWidth * options.Height / iHeight
-			}
-			C.g_object_unref(C.gpointer(image))
+		queueWait.UpdateSince(req.queuedAt)
+		if err := req.ctx.Err(); err != nil {
+			// nobody is waiting for the result anymore
+			req.out <- &ResizeResponse{buf: nil, err: contextError(err)}
+			continue
+		}
+		buf, quality, err := req.vips.resize(req.in, req.options)
+		req.out <- &ResizeResponse{buf: buf, quality: quality, err: err}
+	}
+}
+
+// resize returns the thumbnail of buf, the encoder quality it was saved with,
+// or an *Error.
+func (v *Vips) resize(buf []byte, options Options) ([]byte, int, error) {
+	info, err := v.Probe(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+	iWidth, iHeight := info.Width, info.Height
+	region := options.Region
+	if !region.Empty() {
+		region = region.clip(iWidth, iHeight)
+		if region.Empty() {
+			return nil, 0, &Error{Type: INVALID_OPTIONS, Err: ErrEmptyRegion}
+		}
+		iWidth, iHeight = region.Width, region.Height
+	}
+	options = resolveResizeOp(options, iWidth, iHeight)
+
+	format := options.Format
+	if !savers[format] {
+		format = saveType(info)
+	}
+	animated := false
+	if isAnimation(info.Type, info.Pages) {
+		format = animationSaveType(format)
+		animated = v.config.animate(format, iWidth, iHeight, info.Pages, options)
+	}
+	if animated {
+		// Probe only counted the first frame, every one is decoded
+		if err := v.config.checkLimits(info, info.Pages); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var origOWidth, origOHeight int
+	if options.ResizeOp == FIT {
+		origOWidth = options.Width
+		origOHeight = options.Height
+		options.Width, options.Height = containSize(iWidth, iHeight, options.Width, options.Height, options.NoEnlarge)
+	}
+
+	exportProfile := ""
+	if v.config.ColorConvert {
+		exportProfile = "srgb"
+		if options.WideGamut {
+			exportProfile = "p3"
+		}
+	}
+	thumbOptions := options
+	if anchoredCrop(options) {
+		// thumbnailed to cover the size, then cropped at the gravity
+		thumbOptions.ResizeOp = FILL
+		thumbOptions.Width, thumbOptions.Height = coverSize(iWidth, iHeight, options.Width, options.Height)
+	}
+	var image *C.VipsImage
+	if region.Empty() {
+		image, err = vipsThumbnail(buf, thumbOptions, exportProfile, animated)
+	} else {
+		image, err = vipsThumbnailRegion(buf, region, thumbOptions, exportProfile)
+	}
+	if err != nil {
+		return nil, 0, &Error{Type: CORRUPT_INPUT, Err: err}
+	}
+
+	if anchoredCrop(options) {
+		prevImage := image
+		x, y := cropOffset(options,
+			int(C.vips_image_get_width(prevImage)),
+			int(C.vips_image_get_height(prevImage)),
+			options.Width,
+			options.Height)
+		image, err = vipsExtractArea(prevImage, x, y, options.Width, options.Height)
+		C.g_object_unref(C.gpointer(prevImage))
+		if err != nil {
+			return nil, 0, &Error{Type: ENCODER_FAILURE, Err: err}
+		}
+	}
+
+	if len(options.ExtendBackground) > 0 {
+		prevImage := image
+		x := (origOWidth - options.Width) / 2
+		y := (origOHeight - options.Height) / 2
+		image, err = vipsEmbed(prevImage, x, y, origOWidth, origOHeight, options.ExtendBackground)
+		C.g_object_unref(C.gpointer(prevImage))
+		if err != nil {
+			return nil, 0, &Error{Type: ENCODER_FAILURE, Err: err}
 		}
+	}
 
-		image, err := vipsThumbnail(buf, options.Width, options.Height, options.Gravity)
+	if options.Flip {
+		prevImage := image
+		image, err = vipsFlip(prevImage)
+		C.g_object_unref(C.gpointer(prevImage))
 		if err != nil {
-			req.out <- &ResizeResponse{buf: nil, err: err}
+			return nil, 0, &Error{Type: ENCODER_FAILURE, Err: err}
 		}
+	}
 
-		if len(options.ExtendBackground) > 0 {
-			prevImage := image
-			x := (origOWidth - options.Width) / 2
-			y := (origOHeight - options.Height) / 2
-			image, err = vipsEmbed(prevImage, x, y, origOWidth, origOHeight, options.ExtendBackground)
-			C.g_object_unref(C.gpointer(prevImage))
-			if err != nil {
-				req.out <- &ResizeResponse{buf: nil, err: err}
-			}
+	if angle := rotation(options.Rotate); angle != 0 {
+		prevImage := image
+		image, err = vipsRotate(prevImage, angle)
+		C.g_object_unref(C.gpointer(prevImage))
+		if err != nil {
+			return nil, 0, &Error{Type: ENCODER_FAILURE, Err: err}
 		}
+	}
 
-		thumbBuf, err := vipsSave(GetImageType(buf), image)
-		C.g_object_unref(C.gpointer(image))
+	if options.ColorMode != COLOR {
+		prevImage := image
+		image, err = vipsColorMode(prevImage, options.ColorMode)
+		C.g_object_unref(C.gpointer(prevImage))
 		if err != nil {
-			req.out <- &ResizeResponse{buf: nil, err: err}
+			return nil, 0, &Error{Type: ENCODER_FAILURE, Err: err}
 		}
-		req.out <- &ResizeResponse{buf: thumbBuf, err: nil}
 	}
+
+	policy := v.config.MetadataPolicy
+	if policy == STRIP_ALL && exportProfile == "p3" {
+		// without its profile the image would be displayed as sRGB
+		policy = KEEP_ICC
+	}
+	if policy != STRIP_ALL {
+		prevImage := image
+		image, err = vipsMetadataPolicy(prevImage, policy)
+		C.g_object_unref(C.gpointer(prevImage))
+		if err != nil {
+			return nil, 0, &Error{Type: ENCODER_FAILURE, Err: err}
+		}
+	}
+	defer C.g_object_unref(C.gpointer(image))
+
+	options = v.config.withEncodeDefaults(format, options)
+	if options.MaxBytes > 0 {
+		return vipsSaveBudget(format, image, options, policy == STRIP_ALL)
+	}
+	thumbBuf, err := vipsSave(format, image, options, policy == STRIP_ALL)
+	if err != nil {
+		return nil, 0, &Error{Type: ENCODER_FAILURE, Err: err}
+	}
+	return thumbBuf, options.Quality, nil
+}
+
+// Vips is the libvips Imager. Resizes are run by a pool of workers locked to
+// their OS threads, shared by every Vips: libvips is global, so the pool and
+// libvips settings of the first Vips to resize apply to all of them.
+type Vips struct {
+	config Config
+}
+
+// New returns the Imager of this build.
+func New(config Config) Imager {
+	return &Vips{config: config}
 }
 
-func ShutdownVIPS() {
+func (v *Vips) SupportedFormats() []ImageType {
+	return supportedFormats()
+}
+
+func Shutdown() {
 	C.vips_shutdown()
 }
 
-func GetImageType(buf []byte) ImageType {
-	if len(buf) < 12 {
-		return UNKNOWN
+// Probe reads the header of buf, without decoding pixels, and checks it
+// against the configured limits. An *Error wrapping a *LimitError is returned
+// along with the image info when any is exceeded.
+func (v *Vips) Probe(buf []byte) (Info, error) {
+	imageType := GetImageType(buf)
+	if !loaders[imageType] {
+		return Info{}, &Error{Type: UNSUPPORTED_FORMAT, Err: ErrUnsupportedFormat}
+	}
+	header, err := vipsImageNew(buf) // this is efficient because vips only reads bytes as needed
+	if err != nil {
+		return Info{}, &Error{Type: CORRUPT_INPUT, Err: err}
 	}
-	if buf[0] == 0xFF && buf[1] == 0xD8 && buf[2] == 0xFF {
-		return JPEG
+	defer C.g_object_unref(C.gpointer(header))
+	info := Info{
+		Type:   imageType,
+		Width:  int(C.vips_image_get_width(header)),
+		Height: int(C.vips_image_get_height(header)),
+		Pages:  int(C.vips_image_get_pages_cgo(header)),
+		Alpha:  C.vips_image_hasalpha(header) != 0,
 	}
-	if buf[0] == 0x89 && buf[1] == 0x50 && buf[2] == 0x4E && buf[3] == 0x47 {
-		return PNG
+	if C.vips_image_get_orientation_cgo(header) >= 5 {
+		// thumbnails are auto-rotated, orientations 5-8 swap the axes
+		info.Width, info.Height = info.Height, info.Width
 	}
-	return UNKNOWN
+	return info, v.config.checkLimits(info, 1)
 }
 
-func Resize(buf []byte, options Options) ([]byte, error) {
-	resizeReq := &ResizeRequest{in: buf, options: options, out: make(chan *ResizeResponse)}
-	reqChan <- resizeReq
-	res := <-resizeReq.out
-	return res.buf, res.err
+// Resize returns the thumbnail of buf and the encoder quality it was saved
+// with. It gives up when ctx is done or the configured timeout expires.
+// Requests still queued by then are dropped without being processed. An
+// OVERLOADED error is returned straight away when the queue is full.
+func (v *Vips) Resize(ctx context.Context, buf []byte, options Options) ([]byte, int, error) {
+	startOnce.Do(func() { start(v.config) })
+	if v.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.config.Timeout)
+		defer cancel()
+	}
+	// buffered, the worker mustn't block on requests nobody waits for
+	resizeReq := &ResizeRequest{
+		ctx:      ctx,
+		vips:     v,
+		in:       buf,
+		options:  options,
+		out:      make(chan *ResizeResponse, 1),
+		queuedAt: time.Now(),
+	}
+	select {
+	case reqChan <- resizeReq:
+	default:
+		metrics.GetOrRegisterMeter("imager.queue.rejected", nil).Mark(1)
+		return nil, 0, &Error{Type: OVERLOADED, Err: ErrQueueFull}
+	}
+	select {
+	case res := <-resizeReq.out:
+		return res.buf, res.quality, res.err
+	case <-ctx.Done():
+		return nil, 0, contextError(ctx.Err())
+	}
 }
 
 func vipsEmbed(
@@ -196,11 +377,16 @@ func vipsImageNew(buf []byte) (*C.VipsImage, error) {
 	return image, nil
 }
 
-func vipsThumbnail(buf []byte, width int, height int, gravity GravityType) (*C.VipsImage, error) {
-	smart := gravity == SMART
-	cSmart := C.int(0)
-	if smart {
-		cSmart = C.int(1)
+func vipsThumbnail(
+	buf []byte,
+	options Options,
+	exportProfile string,
+	allPages bool) (*C.VipsImage, error) {
+
+	var cExportProfile *C.char
+	if exportProfile != "" {
+		cExportProfile = C.CString(exportProfile)
+		defer C.free(unsafe.Pointer(cExportProfile))
 	}
 
 	var image *C.VipsImage
@@ -209,19 +395,109 @@ func vipsThumbnail(buf []byte, width int, height int, gravity GravityType) (*C.V
 		unsafe.Pointer(&buf[0]),
 		C.size_t(len(buf)),
 		&image,
-		C.int(width),
-		C.int(height),
-		cSmart)
+		C.int(options.Width),
+		C.int(options.Height),
+		cBool(options.Gravity == SMART),
+		cBool(options.ResizeOp == FILL),
+		cExportProfile,
+		cBool(allPages))
+	if err != 0 {
+		return nil, vipsError()
+	}
+	return image, nil
+}
+
+// vipsThumbnailRegion is vipsThumbnail for region of the auto-rotated image.
+func vipsThumbnailRegion(
+	buf []byte,
+	region Region,
+	options Options,
+	exportProfile string) (*C.VipsImage, error) {
+
+	var cExportProfile *C.char
+	if exportProfile != "" {
+		cExportProfile = C.CString(exportProfile)
+		defer C.free(unsafe.Pointer(cExportProfile))
+	}
+
+	var image *C.VipsImage
+	err := C.vips_thumbnail_region_cgo(
+		unsafe.Pointer(&buf[0]),
+		C.size_t(len(buf)),
+		&image,
+		C.int(region.X),
+		C.int(region.Y),
+		C.int(region.Width),
+		C.int(region.Height),
+		C.int(options.Width),
+		C.int(options.Height),
+		cBool(options.Gravity == SMART),
+		cBool(options.ResizeOp == FILL),
+		cExportProfile)
 	if err != 0 {
 		return nil, vipsError()
 	}
 	return image, nil
 }
 
-func vipsSave(imageType ImageType, image *C.VipsImage) ([]byte, error) {
+func vipsExtractArea(in *C.VipsImage, x int, y int, width int, height int) (*C.VipsImage, error) {
+	var image *C.VipsImage
+	err := C.vips_extract_area_cgo(in, &image, C.int(x), C.int(y), C.int(width), C.int(height))
+	if err != 0 {
+		return nil, vipsError()
+	}
+	return image, nil
+}
+
+func vipsFlip(in *C.VipsImage) (*C.VipsImage, error) {
+	var image *C.VipsImage
+	err := C.vips_flip_cgo(in, &image)
+	if err != 0 {
+		return nil, vipsError()
+	}
+	return image, nil
+}
+
+func vipsRotate(in *C.VipsImage, angle int) (*C.VipsImage, error) {
+	var image *C.VipsImage
+	err := C.vips_rot_cgo(in, &image, C.int(angle))
+	if err != 0 {
+		return nil, vipsError()
+	}
+	return image, nil
+}
+
+func vipsColorMode(in *C.VipsImage, mode ColorModeType) (*C.VipsImage, error) {
+	var image *C.VipsImage
+	err := C.vips_color_mode_cgo(in, &image, cBool(mode == BITONAL))
+	if err != 0 {
+		return nil, vipsError()
+	}
+	return image, nil
+}
+
+func vipsMetadataPolicy(in *C.VipsImage, policy MetadataPolicyType) (*C.VipsImage, error) {
+	var image *C.VipsImage
+	err := C.vips_metadata_policy_cgo(in, &image, C.int(policy))
+	if err != 0 {
+		return nil, vipsError()
+	}
+	return image, nil
+}
+
+func vipsSave(imageType ImageType, image *C.VipsImage, options Options, strip bool) ([]byte, error) {
 	var ptr unsafe.Pointer
 	length := C.size_t(0)
-	err := C.vips_save_buffer_cgo(C.int(imageType), image, &ptr, &length)
+	saveOptions := C.SaveOptions{
+		quality:      C.int(options.Quality),
+		progressive:  cBool(options.Progressive),
+		compression:  C.int(options.Compression),
+		palette:      cBool(options.Palette),
+		lossless:     cBool(options.Lossless),
+		nearLossless: cBool(options.NearLossless),
+		strip:        cBool(strip),
+	}
+	err := C.vips_save_buffer_cgo(C.int(imageType), image, &ptr, &length, &saveOptions)
 	if err != 0 {
 		return nil, vipsError()
 	}
@@ -230,6 +506,33 @@ func vipsSave(imageType ImageType, image *C.VipsImage) ([]byte, error) {
 	return buf, nil
 }
 
+// vipsSaveBudget is saveBudget for libvips images.
+func vipsSaveBudget(imageType ImageType, image *C.VipsImage, options Options, strip bool) ([]byte, int, error) {
+	// the image is encoded several times, so it must only be decoded once
+	memImage := C.vips_image_copy_memory(image)
+	if memImage == nil {
+		return nil, 0, &Error{Type: CORRUPT_INPUT, Err: vipsError()}
+	}
+	defer C.g_object_unref(C.gpointer(memImage))
+
+	return saveBudget(imageType, options, func(options Options) ([]byte, error) {
+		return vipsSave(imageType, memImage, options, strip)
+	})
+}
+
+func cBool(b bool) C.int {
+	if b {
+		return C.int(1)
+	}
+	return C.int(0)
+}
+
+func vipsOperationExists(name string) bool {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	return C.vips_operation_exists_cgo(cName) != 0
+}
+
 func vipsError() error {
 	s := C.GoString(C.vips_error_buffer())
 	C.vips_error_clear()
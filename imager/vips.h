@@ -1,32 +1,130 @@
+#include <string.h>
 #include "vips/vips.h"
 
 enum imageTypes {
     UNKNOWN = 0,
     JPEG,
-    PNG
+    PNG,
+    WEBP,
+    HEIF,
+    AVIF,
+    GIF
 };
 
-int vips_save_buffer_cgo(int imageType, VipsImage *in, void **buf, size_t *len) {
+typedef struct {
+    int quality;
+    int progressive;
+    int compression;
+    int palette;
+    int lossless;
+    int nearLossless;
+    int strip;
+} SaveOptions;
+
+int vips_save_buffer_cgo(int imageType, VipsImage *in, void **buf, size_t *len, SaveOptions *opts) {
     int err = 1;
     switch (imageType) {
     case JPEG:
         err = vips_jpegsave_buffer(in, buf, len,
+            "Q", opts->quality,
+            "interlace", opts->progressive,
             "optimize_coding", TRUE,
-            "strip", TRUE,
+            "strip", opts->strip,
             NULL);
         break;
     case PNG:
-         err = vips_pngsave_buffer(in, buf, len, NULL);
-         break;
+        // palette and Q need libvips 8.7, only pass them when requested
+        if (opts->palette) {
+            err = vips_pngsave_buffer(in, buf, len,
+                "compression", opts->compression,
+                "interlace", opts->progressive,
+                "palette", TRUE,
+                "Q", opts->quality,
+                "strip", opts->strip,
+                NULL);
+        } else {
+            err = vips_pngsave_buffer(in, buf, len,
+                "compression", opts->compression,
+                "interlace", opts->progressive,
+                "strip", opts->strip,
+                NULL);
+        }
+        break;
+    case WEBP:
+        err = vips_webpsave_buffer(in, buf, len,
+            "Q", opts->quality,
+            "lossless", opts->lossless,
+            "near_lossless", opts->nearLossless,
+            "strip", opts->strip,
+            NULL);
+        break;
+    case AVIF:
+#if VIPS_MAJOR_VERSION > 8 || (VIPS_MAJOR_VERSION == 8 && VIPS_MINOR_VERSION >= 9)
+        err = vips_heifsave_buffer(in, buf, len,
+            "Q", opts->quality,
+            "compression", VIPS_FOREIGN_HEIF_COMPRESSION_AV1,
+            "strip", opts->strip,
+            NULL);
+#endif
+        break;
+    case GIF:
+        err = vips_gifsave_buffer(in, buf, len,
+            "strip", opts->strip,
+            NULL);
+        break;
     }
     return err;
 }
 
-int vips_thumbnail_cgo(void *buf, size_t len, VipsImage **out, int width, int height, int smart) {
+// vips_can_save_cgo reports whether a 1x1 image can be saved as imageType,
+// e.g. AVIF needs libvips 8.9 and libheif with an AV1 encoder, which the
+// existence of heifsave doesn't prove.
+int vips_can_save_cgo(int imageType) {
+    VipsImage *in;
+    void *buf = NULL;
+    size_t len = 0;
+    SaveOptions opts = {.quality = 50, .compression = 6, .strip = TRUE};
+    if (vips_black(&in, 1, 1, "bands", 3, NULL)) {
+        vips_error_clear();
+        return 0;
+    }
+    int err = vips_save_buffer_cgo(imageType, in, &buf, &len, &opts);
+    g_object_unref(in);
+    if (err) {
+        vips_error_clear();
+        return 0;
+    }
+    g_free(buf);
+    return 1;
+}
+
+int vips_thumbnail_cgo(void *buf, size_t len, VipsImage **out, int width, int height, int smart, int force, const char *exportProfile, int allPages) {
     VipsInteresting crop = VIPS_INTERESTING_CENTRE;
     if (smart > 0) {
         crop = VIPS_INTERESTING_ATTENTION;
     }
+    VipsSize size = VIPS_SIZE_BOTH;
+    if (force > 0) {
+        crop = VIPS_INTERESTING_NONE;
+        size = VIPS_SIZE_FORCE;
+    }
+    // animations are loaded as a tall strip of frames, see page-height
+    const char *loadOptions = allPages ? "n=-1" : "";
+    if (exportProfile == NULL) {
+        return vips_thumbnail_buffer(
+            buf,
+            len,
+            out,
+            width,
+            "height", height,
+            "crop", crop,
+            "size", size,
+            "intent", VIPS_INTENT_PERCEPTUAL,
+            "auto_rotate", TRUE,
+            "option_string", loadOptions,
+            NULL);
+    }
+    // images without an embedded profile are assumed to be sRGB
     return vips_thumbnail_buffer(
         buf,
         len,
@@ -34,10 +132,71 @@ int vips_thumbnail_cgo(void *buf, size_t len, VipsImage **out, int width, int he
         width,
         "height", height,
         "crop", crop,
+        "size", size,
         "intent", VIPS_INTENT_PERCEPTUAL,
+        "auto_rotate", TRUE,
+        "import_profile", "srgb",
+        "export_profile", exportProfile,
+        "option_string", loadOptions,
         NULL);
 }
 
+// vips_thumbnail_region_cgo is vips_thumbnail_cgo for an area of the
+// auto-rotated image. It can't shrink on load, the whole image is decoded.
+int vips_thumbnail_region_cgo(void *buf, size_t len, VipsImage **out, int left, int top, int areaWidth, int areaHeight, int width, int height, int smart, int force, const char *exportProfile) {
+    VipsImage *base = vips_image_new_from_buffer(buf, len, "", NULL);
+    if (base == NULL) {
+        return 1;
+    }
+    VipsImage *rotated;
+    int err = vips_autorot(base, &rotated, NULL);
+    g_object_unref(base);
+    if (err) {
+        return err;
+    }
+    VipsImage *area;
+    err = vips_extract_area(rotated, &area, left, top, areaWidth, areaHeight, NULL);
+    g_object_unref(rotated);
+    if (err) {
+        return err;
+    }
+
+    VipsInteresting crop = VIPS_INTERESTING_CENTRE;
+    if (smart > 0) {
+        crop = VIPS_INTERESTING_ATTENTION;
+    }
+    VipsSize size = VIPS_SIZE_BOTH;
+    if (force > 0) {
+        crop = VIPS_INTERESTING_NONE;
+        size = VIPS_SIZE_FORCE;
+    }
+    if (exportProfile == NULL) {
+        err = vips_thumbnail_image(
+            area,
+            out,
+            width,
+            "height", height,
+            "crop", crop,
+            "size", size,
+            "intent", VIPS_INTENT_PERCEPTUAL,
+            NULL);
+    } else {
+        err = vips_thumbnail_image(
+            area,
+            out,
+            width,
+            "height", height,
+            "crop", crop,
+            "size", size,
+            "intent", VIPS_INTENT_PERCEPTUAL,
+            "import_profile", "srgb",
+            "export_profile", exportProfile,
+            NULL);
+    }
+    g_object_unref(area);
+    return err;
+}
+
 int vips_image_new_cgo(int imageType, void *buf, size_t len, VipsImage **out) {
     int err = 1;
     switch (imageType) {
@@ -47,6 +206,16 @@ int vips_image_new_cgo(int imageType, void *buf, size_t len, VipsImage **out) {
     case PNG:
          err = vips_pngload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, NULL);
          break;
+    case WEBP:
+        err = vips_webpload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, NULL);
+        break;
+    case HEIF:
+    case AVIF:
+        err = vips_heifload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, NULL);
+        break;
+    case GIF:
+        err = vips_gifload_buffer(buf, len, out, "access", VIPS_ACCESS_SEQUENTIAL, NULL);
+        break;
     }
     return err;
 }
@@ -57,4 +226,119 @@ int vips_embed_background_cgo(VipsImage *in, VipsImage **out, int x, int y, int
     err = vips_embed(in, out, x, y, width, height, "extend", VIPS_EXTEND_BACKGROUND, "background", background, NULL);
     vips_area_unref(VIPS_AREA(background));
     return err;
-}
\ No newline at end of file
+}
+
+int vips_extract_area_cgo(VipsImage *in, VipsImage **out, int left, int top, int width, int height) {
+    return vips_extract_area(in, out, left, top, width, height, NULL);
+}
+
+int vips_flip_cgo(VipsImage *in, VipsImage **out) {
+    return vips_flip(in, out, VIPS_DIRECTION_HORIZONTAL, NULL);
+}
+
+int vips_rot_cgo(VipsImage *in, VipsImage **out, int angle) {
+    VipsAngle vipsAngle = VIPS_ANGLE_D0;
+    switch (angle) {
+    case 90:
+        vipsAngle = VIPS_ANGLE_D90;
+        break;
+    case 180:
+        vipsAngle = VIPS_ANGLE_D180;
+        break;
+    case 270:
+        vipsAngle = VIPS_ANGLE_D270;
+        break;
+    }
+    return vips_rot(in, out, vipsAngle, NULL);
+}
+
+int vips_color_mode_cgo(VipsImage *in, VipsImage **out, int bitonal) {
+    VipsImage *mode;
+    if (vips_colourspace(in, &mode, VIPS_INTERPRETATION_B_W, NULL)) {
+        return 1;
+    }
+    if (bitonal) {
+        // drops alpha, pixels at or above mid-gray become white, the rest black
+        VipsImage *band;
+        int err = vips_extract_band(mode, &band, 0, NULL);
+        g_object_unref(mode);
+        if (err) {
+            return err;
+        }
+        err = vips_moreeq_const1(band, &mode, 128.0, NULL);
+        g_object_unref(band);
+        if (err) {
+            return err;
+        }
+    }
+    // the RGB profile no longer applies, it's removed from a copy as
+    // operation outputs are shared through the libvips cache
+    int err = vips_copy(mode, out, NULL);
+    g_object_unref(mode);
+    if (err) {
+        return err;
+    }
+    vips_image_remove(*out, "icc-profile-data");
+    return 0;
+}
+
+int vips_operation_exists_cgo(const char *nickname) {
+    return vips_type_find("VipsOperation", nickname) != 0;
+}
+
+int vips_image_get_orientation_cgo(VipsImage *in) {
+    int orientation = 1;
+    if (vips_image_get_typeof(in, "orientation")) {
+        vips_image_get_int(in, "orientation", &orientation);
+    }
+    return orientation;
+}
+
+int vips_image_get_pages_cgo(VipsImage *in) {
+    int pages = 1;
+    if (vips_image_get_typeof(in, "n-pages")) {
+        vips_image_get_int(in, "n-pages", &pages);
+    }
+    return pages;
+}
+
+enum metadataPolicies {
+    STRIP_ALL = 0,
+    KEEP_ICC,
+    KEEP_COPYRIGHT,
+    STRIP_GPS
+};
+
+static int vips_keep_field(const char *name, int policy) {
+    switch (policy) {
+    case KEEP_ICC:
+        return strcmp(name, "icc-profile-data") == 0;
+    case KEEP_COPYRIGHT:
+        return strcmp(name, "icc-profile-data") == 0 ||
+            strcmp(name, "iptc-data") == 0 ||
+            strcmp(name, "exif-ifd0-Copyright") == 0 ||
+            strcmp(name, "exif-ifd0-Artist") == 0;
+    case STRIP_GPS:
+        // exif-data is rebuilt on save from the remaining exif-ifd fields,
+        // ifd3 is the GPS IFD
+        return strcmp(name, "exif-data") != 0 &&
+            strcmp(name, "xmp-data") != 0 &&
+            strncmp(name, "exif-ifd3-", 10) != 0;
+    }
+    return 0;
+}
+
+int vips_metadata_policy_cgo(VipsImage *in, VipsImage **out, int policy) {
+    if (vips_copy(in, out, NULL)) {
+        return 1;
+    }
+    gchar **fields = vips_image_get_fields(*out);
+    for (int i = 0; fields[i] != NULL; i++) {
+        if (!vips_keep_field(fields[i], policy)) {
+            // fails harmlessly on non-metadata fields such as width
+            vips_image_remove(*out, fields[i]);
+        }
+    }
+    g_strfreev(fields);
+    return 0;
+}
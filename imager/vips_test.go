@@ -0,0 +1,348 @@
+//go:build cgo && !purego
+// +build cgo,!purego
+
+package imager
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/gif"
+	_ "image/jpeg"
+	"io/ioutil"
+	"testing"
+)
+
+func TestResize_WebP(t *testing.T) {
+	v := New(testConfig)
+	tests := []struct {
+		filename string
+		format   ImageType
+		expected ImageType
+	}{
+		{"1x1-lossy.webp", WEBP, WEBP},
+		{"1x1-lossless.webp", WEBP, WEBP},
+		{"1x1-alpha.webp", WEBP, WEBP},
+		// without a format, in one every client decodes
+		{"1x1-lossy.webp", UNKNOWN, JPEG},
+		{"1x1-alpha.webp", UNKNOWN, PNG},
+	}
+	for _, test := range tests {
+		buf, err := ioutil.ReadFile("../testdata/" + test.filename)
+		if err != nil {
+			t.Errorf("Could not read test file %s", test.filename)
+			continue
+		}
+		thumbBuf, _, err := v.Resize(context.Background(), buf,
+			Options{Width: 10, Height: 10, ResizeOp: CROP, Gravity: CENTER, Format: test.format})
+		if err != nil {
+			t.Errorf("%s: resize failed: %v", test.filename, err)
+			continue
+		}
+		if format := GetImageType(thumbBuf); format != test.expected {
+			t.Errorf("%s as %d: expected format %d, got %d", test.filename, test.format, test.expected, format)
+		}
+	}
+}
+
+func TestResize_MaxBytes(t *testing.T) {
+	v := New(testConfig)
+	buf, err := ioutil.ReadFile("../testdata/samuel-clara-69657-unsplash.jpg")
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	options := Options{Width: 480, Height: 640, ResizeOp: CROP, Gravity: CENTER, Quality: 95}
+	fullBuf, quality, err := v.Resize(context.Background(), buf, options)
+	if err != nil || quality != 95 {
+		t.Fatalf("resize failed: %v", err)
+	}
+
+	options.MaxBytes = len(fullBuf) / 2
+	thumbBuf, quality, err := v.Resize(context.Background(), buf, options)
+	if err != nil {
+		t.Fatalf("resize with byte budget failed: %v", err)
+	}
+	if len(thumbBuf) > options.MaxBytes {
+		t.Errorf("thumbnail is %d bytes, budget is %d", len(thumbBuf), options.MaxBytes)
+	}
+	if quality < 1 || quality >= 95 {
+		t.Errorf("expected quality below 95, got %d", quality)
+	}
+
+	options.MaxBytes = 100
+	_, _, err = v.Resize(context.Background(), buf, options)
+	if imagerErr, ok := err.(*Error); !ok || imagerErr.Err != ErrByteBudgetExceeded {
+		t.Errorf("expected ErrByteBudgetExceeded, got %v", err)
+	}
+}
+
+func TestResize_Orientation(t *testing.T) {
+	v := New(testConfig)
+	// 480x320 pixels with EXIF orientation 6, displayed as 320x480
+	buf, err := ioutil.ReadFile("../testdata/orientation-6.jpg")
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	for _, options := range []Options{
+		{Width: 100, Height: 100, ResizeOp: FIT},
+		{Width: 60, Height: 100, ResizeOp: CROP, Gravity: CENTER},
+	} {
+		thumbBuf, _, err := v.Resize(context.Background(), buf, options)
+		if err != nil {
+			t.Errorf("resize failed: %v", err)
+			continue
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(thumbBuf))
+		if err != nil {
+			t.Errorf("could not decode thumbnail: %v", err)
+			continue
+		}
+		if cfg.Width >= cfg.Height {
+			t.Errorf("expected a portrait thumbnail, got %dx%d", cfg.Width, cfg.Height)
+		}
+	}
+}
+
+func TestResize_Transform(t *testing.T) {
+	v := New(testConfig)
+	// displayed as 320x480, regions are in displayed pixels
+	buf, err := ioutil.ReadFile("../testdata/orientation-6.jpg")
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	tests := []struct {
+		options Options
+		width   int
+		height  int
+	}{
+		{Options{Width: 32, Height: 12, ResizeOp: FILL, Region: Region{Width: 320, Height: 120}}, 32, 12},
+		{Options{Width: 32, Height: 12, ResizeOp: FILL, Region: Region{Y: 360, Width: 320, Height: 240}}, 32, 12},
+		{Options{Width: 32, Height: 48, ResizeOp: FILL, Rotate: 90, Flip: true}, 48, 32},
+		{Options{Width: 32, Height: 48, ResizeOp: FILL, ColorMode: BITONAL}, 32, 48},
+		{Options{Width: 50, Height: 30, ResizeOp: CROP, Gravity: SOUTH_WEST}, 50, 30},
+		{Options{Width: 50, Height: 30, ResizeOp: CROP, Gravity: FOCAL, FocalX: 0.2, FocalY: 0.9,
+			Region: Region{X: 10, Y: 10, Width: 200, Height: 200}}, 50, 30},
+		{Options{Width: 10, Height: 10, ResizeOp: SCALE}, 32, 48},
+		{Options{Width: 100, Height: 100, ResizeOp: INSIDE}, 66, 100},
+		{Options{Width: 100, Height: 100, ResizeOp: OUTSIDE}, 100, 150},
+		{Options{Width: 1000, Height: 1000, ResizeOp: INSIDE, NoEnlarge: true}, 320, 480},
+		{Options{Width: 1000, Height: 100, ResizeOp: CROP, Gravity: CENTER, NoEnlarge: true}, 320, 100},
+	}
+	for _, test := range tests {
+		thumbBuf, _, err := v.Resize(context.Background(), buf, test.options)
+		if err != nil {
+			t.Errorf("%+v: resize failed: %v", test.options, err)
+			continue
+		}
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(thumbBuf))
+		if err != nil {
+			t.Errorf("%+v: could not decode thumbnail: %v", test.options, err)
+			continue
+		}
+		if cfg.Width != test.width || cfg.Height != test.height {
+			t.Errorf("%+v: expected %dx%d, got %dx%d",
+				test.options, test.width, test.height, cfg.Width, cfg.Height)
+		}
+		if test.options.ColorMode != COLOR && cfg.ColorModel != color.GrayModel {
+			t.Errorf("%+v: expected a grayscale thumbnail", test.options)
+		}
+	}
+
+	outside := Options{Width: 32, Height: 12, ResizeOp: FILL, Region: Region{X: 320, Width: 100, Height: 100}}
+	_, _, err = v.Resize(context.Background(), buf, outside)
+	if imagerErr, ok := err.(*Error); !ok || imagerErr.Type != INVALID_OPTIONS {
+		t.Errorf("expected an INVALID_OPTIONS error, got %v", err)
+	}
+}
+
+func TestResize_ColorConvert(t *testing.T) {
+	// solid rgb(200, 100, 50) with an embedded Adobe RGB profile, which is
+	// about rgb(227, 100, 42) in sRGB
+	buf, err := ioutil.ReadFile("../testdata/adobe-rgb.jpg")
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	tests := []struct {
+		convert bool
+		minRed  uint32
+		maxRed  uint32
+	}{
+		{true, 220, 235},
+		{false, 195, 205},
+	}
+	for _, test := range tests {
+		config := testConfig
+		config.ColorConvert = test.convert
+		thumbBuf, _, err := New(config).Resize(context.Background(), buf,
+			Options{Width: 16, Height: 16, ResizeOp: CROP, Gravity: CENTER})
+		if err != nil {
+			t.Errorf("resize failed: %v", err)
+			continue
+		}
+		img, _, err := image.Decode(bytes.NewReader(thumbBuf))
+		if err != nil {
+			t.Errorf("could not decode thumbnail: %v", err)
+			continue
+		}
+		r, _, _, _ := img.At(8, 8).RGBA()
+		if r>>8 < test.minRed || r>>8 > test.maxRed {
+			t.Errorf("convert=%v: expected red between %d and %d, got %d",
+				test.convert, test.minRed, test.maxRed, r>>8)
+		}
+	}
+}
+
+func TestResize_MetadataPolicy(t *testing.T) {
+	// EXIF make, artist, copyright and GPS map datum, an IPTC keyword and an
+	// ICC profile
+	buf, err := ioutil.ReadFile("../testdata/metadata.jpg")
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	fields := []string{"ICC_PROFILE", "IPTCKEYWORD", "(c) Jane Doe", "TestCam", "SECRETDATUM"}
+	tests := []struct {
+		policy MetadataPolicyType
+		kept   []bool // fields
+	}{
+		{STRIP_ALL, []bool{false, false, false, false, false}},
+		{KEEP_ICC, []bool{true, false, false, false, false}},
+		{KEEP_COPYRIGHT, []bool{true, true, true, false, false}},
+		{STRIP_GPS, []bool{true, true, true, true, false}},
+	}
+	for _, test := range tests {
+		config := testConfig
+		config.MetadataPolicy = test.policy
+		thumbBuf, _, err := New(config).Resize(context.Background(), buf,
+			Options{Width: 16, Height: 16, ResizeOp: CROP, Gravity: CENTER})
+		if err != nil {
+			t.Errorf("policy %d: resize failed: %v", test.policy, err)
+			continue
+		}
+		for i, field := range fields {
+			if kept := bytes.Contains(thumbBuf, []byte(field)); kept != test.kept[i] {
+				t.Errorf("policy %d: expected %q kept=%v, got %v", test.policy, field, test.kept[i], kept)
+			}
+		}
+	}
+}
+
+func TestResize_AnimatedGIF(t *testing.T) {
+	if !savers[GIF] {
+		t.Skip("libvips can't save GIF")
+	}
+	// 64x48, 3 frames
+	buf, err := ioutil.ReadFile("../testdata/animated.gif")
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	tests := []struct {
+		enable bool
+		frames int
+	}{
+		{true, 3},
+		{false, 1},
+	}
+	for _, test := range tests {
+		config := testConfig
+		config.AnimationEnable = test.enable
+		thumbBuf, _, err := New(config).Resize(context.Background(), buf,
+			Options{Width: 32, Height: 32, ResizeOp: CROP, Gravity: CENTER})
+		if err != nil {
+			t.Errorf("resize failed: %v", err)
+			continue
+		}
+		anim, err := gif.DecodeAll(bytes.NewReader(thumbBuf))
+		if err != nil {
+			t.Errorf("could not decode thumbnail: %v", err)
+			continue
+		}
+		if len(anim.Image) != test.frames {
+			t.Errorf("enable=%v: expected %d frames, got %d", test.enable, test.frames, len(anim.Image))
+		}
+		if b := anim.Image[0].Bounds(); b.Dx() != 32 || b.Dy() != 32 {
+			t.Errorf("expected 32x32 frames, got %dx%d", b.Dx(), b.Dy())
+		}
+	}
+}
+
+func TestProbe_Limits(t *testing.T) {
+	v := New(testConfig)
+	buf, err := ioutil.ReadFile("../testdata/samuel-clara-69657-unsplash.jpg")
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	info, err := v.Probe(buf)
+	if err != nil || info.Type != JPEG || info.Width != 2400 || info.Height != 1600 || info.Pages != 1 {
+		t.Errorf("unexpected info %+v (%v)", info, err)
+	}
+
+	// a tiny PNG declaring 50000x50000 pixels
+	buf, err = ioutil.ReadFile("../testdata/50000x50000.png")
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	_, err = v.Probe(buf)
+	if imagerErr, ok := err.(*Error); !ok || imagerErr.Type != LIMIT_EXCEEDED {
+		t.Errorf("expected LIMIT_EXCEEDED error, got %v", err)
+	} else if limitErr, ok := imagerErr.Err.(*LimitError); !ok || limitErr.Limit != "width" {
+		t.Errorf("expected width LimitError, got %v", imagerErr.Err)
+	}
+	_, _, err = v.Resize(context.Background(), buf,
+		Options{Width: 100, Height: 100, ResizeOp: CROP, Gravity: CENTER})
+	if imagerErr, ok := err.(*Error); !ok || imagerErr.Type != LIMIT_EXCEEDED {
+		t.Errorf("expected LIMIT_EXCEEDED error, got %v", err)
+	}
+
+	config := testConfig
+	config.MaxPages = 2
+	buf, err = ioutil.ReadFile("../testdata/animated.gif")
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	if _, err := New(config).Probe(buf); err == nil {
+		t.Errorf("expected pages LimitError")
+	}
+}
+
+func TestResize_Errors(t *testing.T) {
+	v := New(testConfig)
+	tests := []struct {
+		name      string
+		buf       []byte
+		errorType ErrorType
+	}{
+		{"unknown format", []byte("this is not an image"), UNSUPPORTED_FORMAT},
+		{"broken header", append([]byte{0xFF, 0xD8, 0xFF}, make([]byte, 100)...), CORRUPT_INPUT},
+	}
+	for _, test := range tests {
+		_, _, err := v.Resize(context.Background(), test.buf,
+			Options{Width: 100, Height: 100, ResizeOp: CROP, Gravity: CENTER})
+		if imagerErr, ok := err.(*Error); !ok || imagerErr.Type != test.errorType {
+			t.Errorf("%s: expected error type %d, got %v", test.name, test.errorType, err)
+		}
+	}
+}
+
+func TestResize_ContextDone(t *testing.T) {
+	v := New(testConfig)
+	buf, err := ioutil.ReadFile("../testdata/samuel-clara-69657-unsplash.jpg")
+	if err != nil {
+		t.Fatalf("Could not read test file")
+	}
+	options := Options{Width: 100, Height: 100, ResizeOp: CROP, Gravity: CENTER}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err = v.Resize(ctx, buf, options)
+	if imagerErr, ok := err.(*Error); !ok || imagerErr.Type != CANCELED {
+		t.Errorf("expected CANCELED error, got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	_, _, err = v.Resize(ctx, buf, options)
+	if imagerErr, ok := err.(*Error); !ok || imagerErr.Type != TIMEOUT {
+		t.Errorf("expected TIMEOUT error, got %v", err)
+	}
+}
@@ -17,7 +17,7 @@ import (
 )
 
 func main() {
-	defer imager.ShutdownVIPS()
+	defer imager.Shutdown()
 
 	configPath := flag.String("c", "config.properties", "configuration file path")
 	flag.Parse()
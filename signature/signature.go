@@ -0,0 +1,94 @@
+// Package signature signs and verifies imageresizer URLs. A signature is an
+// HMAC-SHA256 of the URL path and its query parameters, so neither the
+// transform, the original's path nor the expiry can be changed.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Query parameters of signed URLs
+const (
+	SignatureParam = "s"
+	ExpiresParam   = "e" // unix timestamp
+)
+
+var (
+	ErrMissing = errors.New("missing signature")
+	ErrInvalid = errors.New("invalid signature")
+	ErrExpired = errors.New("signature expired")
+)
+
+// Sign returns the signature of path and query, ignoring any signature
+// parameter in query.
+func Sign(key []byte, path string, query url.Values) string {
+	return base64.RawURLEncoding.EncodeToString(sum(key, path, query))
+}
+
+// SignURL returns path with query, its expiry unless expires is zero, and
+// their signature, e.g. /300x300/crop/s/photo.jpg?e=1546300800&s=...
+func SignURL(key []byte, path string, query url.Values, expires time.Time) string {
+	signed := url.Values{}
+	for param, values := range query {
+		signed[param] = values
+	}
+	if !expires.IsZero() {
+		signed.Set(ExpiresParam, strconv.FormatInt(expires.Unix(), 10))
+	}
+	signed.Set(SignatureParam, Sign(key, path, signed))
+	u := &url.URL{Path: path, RawQuery: signed.Encode()}
+	return u.String()
+}
+
+// Verify checks that the signature in query was made by any of keys, so keys
+// can be rotated, and hasn't expired at now.
+func Verify(keys [][]byte, path string, query url.Values, now time.Time) error {
+	signature := query.Get(SignatureParam)
+	if signature == "" {
+		return ErrMissing
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return ErrInvalid
+	}
+	valid := false
+	for _, key := range keys {
+		if hmac.Equal(mac, sum(key, path, query)) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return ErrInvalid
+	}
+	if expiresStr := query.Get(ExpiresParam); expiresStr != "" {
+		expires, err := strconv.ParseInt(expiresStr, 10, 64)
+		if err != nil {
+			return ErrInvalid
+		}
+		if now.Unix() > expires {
+			return ErrExpired
+		}
+	}
+	return nil
+}
+
+func sum(key []byte, path string, query url.Values) []byte {
+	signed := url.Values{}
+	for param, values := range query {
+		if param != SignatureParam {
+			signed[param] = values
+		}
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(path))
+	mac.Write([]byte{'?'})
+	mac.Write([]byte(signed.Encode())) // sorted by parameter
+	return mac.Sum(nil)
+}
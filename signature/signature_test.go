@@ -0,0 +1,65 @@
+package signature
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestSignURL(t *testing.T) {
+	key := []byte("secret")
+	now := time.Unix(1546300800, 0)
+	path := "/300x300/crop/s/dir/my photo.jpg"
+
+	signedURL := SignURL(key, path, nil, time.Time{})
+	u, err := url.Parse(signedURL)
+	if err != nil {
+		t.Fatalf("could not parse signed URL %s", signedURL)
+	}
+	if u.Path != path || u.Query().Get(ExpiresParam) != "" {
+		t.Errorf("unexpected signed URL %s", signedURL)
+	}
+	if err := Verify([][]byte{key}, u.Path, u.Query(), now); err != nil {
+		t.Errorf("expected valid signature, got %v", err)
+	}
+
+	// keys are rotated by adding the new one
+	if err := Verify([][]byte{[]byte("new"), key}, u.Path, u.Query(), now); err != nil {
+		t.Errorf("expected valid signature with rotated keys, got %v", err)
+	}
+	if err := Verify([][]byte{[]byte("new")}, u.Path, u.Query(), now); err != ErrInvalid {
+		t.Errorf("expected ErrInvalid with unknown key, got %v", err)
+	}
+	if err := Verify([][]byte{key}, "/1x1/crop/s/dir/my photo.jpg", u.Query(), now); err != ErrInvalid {
+		t.Errorf("expected ErrInvalid for another path, got %v", err)
+	}
+	if err := Verify([][]byte{key}, u.Path, url.Values{}, now); err != ErrMissing {
+		t.Errorf("expected ErrMissing, got %v", err)
+	}
+}
+
+func TestSignURL_Expires(t *testing.T) {
+	key := []byte("secret")
+	now := time.Unix(1546300800, 0)
+	path := "/300x300/crop/s/photo.jpg"
+	query := url.Values{"w": {"300"}}
+
+	u, _ := url.Parse(SignURL(key, path, query, now.Add(time.Hour)))
+	if err := Verify([][]byte{key}, u.Path, u.Query(), now); err != nil {
+		t.Errorf("expected valid signature, got %v", err)
+	}
+	if err := Verify([][]byte{key}, u.Path, u.Query(), now.Add(2*time.Hour)); err != ErrExpired {
+		t.Errorf("expected ErrExpired, got %v", err)
+	}
+
+	for param, value := range map[string]string{
+		ExpiresParam: "1646300800",
+		"w":          "1",
+	} {
+		tampered := u.Query()
+		tampered.Set(param, value)
+		if err := Verify([][]byte{key}, u.Path, tampered, now); err != ErrInvalid {
+			t.Errorf("%s=%s: expected ErrInvalid, got %v", param, value, err)
+		}
+	}
+}
@@ -1,24 +1,35 @@
 package store
 
+import "github.com/kxlt/imageresizer/coalesce"
+
 type TwoTier struct {
 	Store Store
 	Cache Cache
+
+	// concurrent cache misses for the same file share a single Store.Get
+	gets coalesce.Group
 }
 
 func (s *TwoTier) Get(filename string) ([]byte, error) {
 	var buf []byte
-	var err error
 	if s.Cache != nil {
 		buf, _ = s.Cache.Get(filename)
 	}
 	if buf == nil {
-		buf, err = s.Store.Get(filename)
+		val, err, _ := s.gets.Do(filename, func() (interface{}, error) {
+			buf, err := s.Store.Get(filename)
+			if err != nil {
+				return nil, err
+			}
+			if s.Cache != nil {
+				go s.Cache.Put(filename, buf)
+			}
+			return buf, nil
+		})
 		if err != nil {
 			return nil, err
 		}
-		if s.Cache != nil {
-			go s.Cache.Put(filename, buf)
-		}
+		buf = val.([]byte)
 	}
 	return buf, nil
 }
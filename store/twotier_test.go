@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"io/ioutil"
 	"os"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestTwoTier_Get(t *testing.T) {
@@ -31,3 +34,37 @@ func TestTwoTier_Get(t *testing.T) {
 		t.Errorf("Input and output buffers differ")
 	}
 }
+
+type slowStore struct {
+	gets int32
+	Store
+}
+
+func (s *slowStore) Get(filename string) ([]byte, error) {
+	atomic.AddInt32(&s.gets, 1)
+	time.Sleep(50 * time.Millisecond)
+	return []byte(filename), nil
+}
+
+func TestTwoTier_GetCoalesced(t *testing.T) {
+	store := &slowStore{}
+	twotier := &TwoTier{
+		Store: store,
+		Cache: nil,
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf, err := twotier.Get("a.jpg")
+			if err != nil || string(buf) != "a.jpg" {
+				t.Errorf("Unexpected result: %s, %v", buf, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if store.gets != 1 {
+		t.Errorf("Expected 1 store get, got %d", store.gets)
+	}
+}